@@ -0,0 +1,168 @@
+package socketio
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// AnnotationCompressed marks a message compressed by the codec returned by
+// NewCompressingCodec. Its value is "j" if the compressed data is JSON.
+const AnnotationCompressed = "z"
+
+// CompressingCodec wraps another codec and compresses the large messages.
+type compressingCodec struct {
+	inner   Codec
+	minSize int
+	maxSize int
+}
+
+// NewCompressingCodec returns a codec that wraps inner and compresses each message
+// of at least minSize bytes. The data of such message is deflated and base64 encoded,
+// so it is safe to be sent over any transport, and the message is then encoded
+// with inner and annotated with AnnotationCompressed so the client knows to inflate
+// it. The smaller messages, the heartbeats and the other internal messages are
+// passed to inner as such. The inner codec must support annotations, e.g. SIOCodec.
+// The inbound messages carrying AnnotationCompressed are inflated by the decoder,
+// up to maxSize bytes each: the clients are not trusted, so a message inflating to
+// more than that results in ErrMalformedPayload.
+func NewCompressingCodec(inner Codec, minSize, maxSize int) Codec {
+	return &compressingCodec{inner, minSize, maxSize}
+}
+
+func (cc *compressingCodec) NewEncoder() Encoder {
+	return &compressingEncoder{inner: cc.inner.NewEncoder(), minSize: cc.minSize}
+}
+
+func (cc *compressingCodec) NewDecoder(src *bytes.Buffer) Decoder {
+	return &compressingDecoder{cc.inner.NewDecoder(src), cc.maxSize}
+}
+
+type compressingEncoder struct {
+	inner   Encoder
+	minSize int
+	buf     bytes.Buffer
+}
+
+// Encode compresses payload if it is large enough and encodes it with the
+// inner encoder.
+func (enc *compressingEncoder) Encode(dst io.Writer, payload interface{}) (err os.Error) {
+	data, annotations := payload, map[string]string(nil)
+	if a, ok := payload.(annotated); ok {
+		data, annotations = a.data, a.annotations
+	}
+
+	var raw []byte
+	var isJSON bool
+
+	switch t := data.(type) {
+	case heartbeat, handshake, disconnect, ack:
+		return enc.inner.Encode(dst, payload)
+
+	case []byte:
+		raw = t
+
+	case string:
+		raw = []byte(t)
+
+	case int:
+		raw = []byte(strconv.Itoa(t))
+
+	default:
+		if raw, err = json.Marshal(data); err != nil {
+			return
+		}
+		isJSON = true
+	}
+
+	if len(raw) < enc.minSize {
+		return enc.inner.Encode(dst, payload)
+	}
+
+	enc.buf.Reset()
+	b64 := base64.NewEncoder(base64.StdEncoding, &enc.buf)
+	w := flate.NewWriter(b64, flate.BestSpeed)
+	if _, err = w.Write(raw); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	if err = b64.Close(); err != nil {
+		return
+	}
+
+	meta := make(map[string]string, len(annotations)+1)
+	for key, value := range annotations {
+		meta[key] = value
+	}
+	meta[AnnotationCompressed] = ""
+	if isJSON {
+		meta[AnnotationCompressed] = SIOAnnotationJSON
+	}
+
+	return enc.inner.Encode(dst, annotated{enc.buf.String(), meta})
+}
+
+type compressingDecoder struct {
+	Decoder
+	maxSize int
+}
+
+// Decode decodes the messages with the inner decoder and inflates the compressed
+// ones. If a compressed message can't be inflated or it inflates to more than
+// maxSize bytes, ErrMalformedPayload is returned.
+func (dec *compressingDecoder) Decode() (messages []Message, err os.Error) {
+	if messages, err = dec.Decoder.Decode(); err != nil {
+		return
+	}
+
+	for i, m := range messages {
+		flag, ok := m.Annotation(AnnotationCompressed)
+		if !ok {
+			continue
+		}
+
+		r := flate.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(m.Data())))
+		data, err := ioutil.ReadAll(io.LimitReader(r, int64(dec.maxSize)+1))
+		r.Close()
+		if err != nil || len(data) > dec.maxSize {
+			return nil, ErrMalformedPayload
+		}
+
+		messages[i] = &inflatedMessage{m, string(data), flag == SIOAnnotationJSON}
+	}
+
+	return
+}
+
+// InflatedMessage is a decompressed message.
+type inflatedMessage struct {
+	Message
+	data   string
+	isJSON bool
+}
+
+func (im *inflatedMessage) Type() uint8 {
+	if im.isJSON {
+		return MessageJSON
+	}
+	return MessageText
+}
+
+func (im *inflatedMessage) Data() string {
+	return im.data
+}
+
+func (im *inflatedMessage) JSON() (string, bool) {
+	if im.isJSON {
+		return im.data, true
+	}
+	return "", false
+}
@@ -0,0 +1,92 @@
+package socketio
+
+import (
+	"bytes"
+	"json"
+	"strings"
+	"testing"
+)
+
+func TestCompressingCodecBelowThreshold(t *testing.T) {
+	codec := NewCompressingCodec(SIOCodec{}, 64, 4096)
+	buf := new(bytes.Buffer)
+
+	if err := codec.NewEncoder().Encode(buf, "hello"); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if expect := frame("hello", 1, false); buf.String() != expect {
+		t.Fatalf("Expected %q but got %q", expect, buf.String())
+	}
+
+	messages, err := codec.NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if len(messages) != 1 || messages[0].Type() != MessageText || messages[0].Data() != "hello" {
+		t.Fatalf("Expected a single text message \"hello\", but got %v", messages)
+	}
+}
+
+func TestCompressingCodecAboveThreshold(t *testing.T) {
+	codec := NewCompressingCodec(SIOCodec{}, 64, 4096)
+	buf := new(bytes.Buffer)
+	enc := codec.NewEncoder()
+	dec := codec.NewDecoder(buf)
+
+	text := strings.Repeat("hello, world ", 100)
+	object := map[string]string{"greeting": text}
+
+	if err := enc.Encode(buf, text); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if buf.Len() >= len(text) {
+		t.Fatalf("Expected the frame to be compressed, but it takes %d bytes", buf.Len())
+	}
+	if err := enc.Encode(buf, object); err != nil {
+		t.Fatal("Encode:", err)
+	}
+
+	messages, err := dec.Decode()
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages but got %d", len(messages))
+	}
+
+	if messages[0].Type() != MessageText || messages[0].Data() != text {
+		t.Fatalf("Expected the text to be inflated, but got %q", messages[0].Data())
+	}
+
+	expect, _ := json.Marshal(object)
+	if s, ok := messages[1].JSON(); !ok || s != string(expect) {
+		t.Fatalf("Expected the JSON %s to be inflated, but got %q", expect, messages[1].Data())
+	}
+}
+
+func TestCompressingCodecMaxSize(t *testing.T) {
+	buf := new(bytes.Buffer)
+	text := strings.Repeat("a", 1<<20)
+	if err := NewCompressingCodec(SIOCodec{}, 64, 1<<20).NewEncoder().Encode(buf, text); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	if buf.Len() >= 4096 {
+		t.Fatalf("Expected the frame to be compressed, but it takes %d bytes", buf.Len())
+	}
+	bomb := buf.String()
+
+	// a message inflating to exactly the cap is accepted
+	messages, err := NewCompressingCodec(SIOCodec{}, 64, 1<<20).NewDecoder(bytes.NewBufferString(bomb)).Decode()
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if len(messages) != 1 || len(messages[0].Data()) != len(text) {
+		t.Fatalf("Expected a single message of %d bytes, but got %v", len(text), messages)
+	}
+
+	// a message inflating beyond the cap is refused
+	messages, err = NewCompressingCodec(SIOCodec{}, 64, 4096).NewDecoder(bytes.NewBufferString(bomb)).Decode()
+	if err != ErrMalformedPayload {
+		t.Fatalf("Expected ErrMalformedPayload, but got %d messages and %v", len(messages), err)
+	}
+}
@@ -1,49 +1,279 @@
 package socketio
 
-import "log"
+import (
+	"http"
+	"log"
+	"rand"
+)
+
+// The poll modes of the polling transports.
+const (
+	// LongPoll holds a poll until there is something to deliver or it times out.
+	LongPoll = iota
+
+	// ShortPoll answers a poll immediately with an empty response if there is
+	// nothing to deliver.
+	ShortPoll
+)
+
+// The directions passed to Config.Mirror.
+const (
+	// MirrorIn marks a message received from a client.
+	MirrorIn = iota
+
+	// MirrorOut marks a message sent to a client.
+	MirrorOut
+)
+
+// The capacity policies, see Config.CapacityPolicy.
+const (
+	// Reject refuses the new connections.
+	Reject = iota
+
+	// EvictOldest closes the least recently active connection to make room for
+	// the new one, once the new one has been established.
+	EvictOldest
+)
+
+// The duplicate session policies, see Config.DuplicateSessionPolicy.
+const (
+	// ReplaceOld closes the live socket of the session and binds the new one.
+	ReplaceOld = iota
+
+	// RejectNew refuses the new socket while the session has a live one.
+	RejectNew
+)
 
 // Config represents a set of configurable settings used by the server
 type Config struct {
-	// Maximum number of connections.
+	// Maximum number of connections. When it has been reached, the new connections
+	// are refused with 503 Service Unavailable, unless CapacityPolicy says otherwise.
+	// Zero means unlimited.
 	MaxConnections int
 
+	// Maximum number of new connections created per second. It paces the reconnect
+	// storms, e.g. after a restart: the excess handshakes are refused with 503
+	// Service Unavailable and a Retry-After header, so the clients back off. The
+	// requests of the established connections are not affected. Zero means unlimited.
+	AdmissionRate int
+
+	// What to do with a new connection when MaxConnections has been reached, either
+	// Reject or EvictOldest.
+	CapacityPolicy int
+
+	// What to do when a client binds a new socket to a session that still has a live
+	// socket, e.g. when two browser tabs share a session id, either ReplaceOld or
+	// RejectNew. The refused requests get 401 Unauthorized. Note that a polling
+	// client may start its next poll before the server has noticed the end of the
+	// previous one, so RejectNew suits the persistent transports best.
+	DuplicateSessionPolicy int
+
 	// Maximum amount of messages to store for a connection. If a connection
 	// has QueueLength amount of undelivered messages, the following Sends will
-	// return ErrQueueFull error.
+	// return ErrQueueFull error. The flusher writes at most QueueLength messages
+	// at a time also when NewQueue is set.
 	QueueLength int
 
+	// Maximum number of messages of a connection passed to the OnMessage callback
+	// concurrently. If it is more than 1, each message is handled in a goroutine of its
+	// own and once the limit has been reached, the connection stops receiving until a
+	// handler returns, so a fast client can't pile up slow handlers. The messages are
+	// then handled in no particular order. Zero and 1 mean that the messages are
+	// handled one at a time, in the order they were received.
+	MaxConcurrentHandlers int
+
+	// Period in ns during which an inbound message carrying the same AnnotationID as
+	// an earlier message of the connection is considered a resend. The resends are
+	// not passed to OnMessage, so the clients may resend freely. Zero disables the
+	// deduplication.
+	DedupeWindow int64
+
+	// Acknowledges the resends dropped by DedupeWindow with an empty message
+	// annotated with AnnotationAck, see README.md for the wire format. The stock
+	// clients pass such messages to the application as empty messages, so this is
+	// only for the clients that know to expect them. The acks are not subject to
+	// QueueLength.
+	DedupeAck bool
+
+	// Maximum number of messages delivered in a single response of the polling
+	// transports. The rest of the messages are left for the following polls, which
+	// bounds the size of the responses for the clients with modest parsers. Zero
+	// means that all the pending messages are delivered at once.
+	MaxFramesPerPoll int
+
+	// Period in ns after which a connection whose send queue is full and has not
+	// been flushed is reported as stalled by SocketIO.Probe.
+	StallTimeout int64
+
+	// Disables Nagle's algorithm on the TCP connections of the websocket and
+	// flashsocket transports, so that small messages are sent without delay. It is
+	// set in DefaultConfig, so a Config built from scratch enables Nagle's algorithm.
+	TCPNoDelay bool
+
+	// Enables the TCP keepalive probes of the OS on the TCP connections of the
+	// websocket and flashsocket transports. The interval of the probes is left for
+	// the OS to decide. If false, the connections are left as they were accepted.
+	TCPKeepAlive bool
+
+	// Period in ns during which a websocket closed by the server waits for the
+	// closing frame of the client before the TCP connection is dropped. Only the
+	// draft-76 clients have a closing handshake, the draft-75 ones are dropped right
+	// away. Zero disables the wait.
+	CloseHandshakeTimeout int64
+
+	// Creates the WriteQueue holding the outbound messages of a new connection. If
+	// nil, NewFIFOQueue(QueueLength) is used.
+	NewQueue func() WriteQueue
+
+	// Maximum number of tags a connection can have, see Conn.AddTag. It guards
+	// against clients exhausting the memory when they get to pick their own tags.
+	// Zero means unlimited.
+	MaxTagsPerConn int
+
 	// The size of the read buffer in bytes.
 	ReadBufferSize int
 
+	// Maximum size in bytes of the POST requests that carry the messages of the
+	// polling transports. Larger requests are refused with 413 Request Entity Too
+	// Large. Zero means unlimited.
+	MaxPostBytes int64
+
 	// The interval between heartbeats
 	HeartbeatInterval int64
 
 	// Period in ns during which the client must reconnect or it is considered
-	// disconnected.
+	// disconnected. This is the grace period that makes the polling transports work:
+	// every poll ends by losing the socket and the session survives as long as the
+	// next poll arrives within ReconnectTimeout.
 	ReconnectTimeout int64
 
+	// How the polling transports handle a poll when there is nothing to deliver,
+	// either LongPoll or ShortPoll.
+	PollMode int
+
+	// Maximum rate in messages per second at which the messages that were pending
+	// when a client reconnected are replayed to it. The messages sent after the
+	// reconnect are delivered once the replay is over. Zero means unlimited.
+	ReplayRate int
+
+	// Makes the broadcasts visit the connections in a stable order, sorted by session
+	// id, instead of the random order of a map. It is meant for reproducible tests,
+	// as sorting the connections makes each broadcast O(n log n) instead of O(n).
+	StableBroadcastOrder bool
+
+	// Lets the requests pick their transport with a query parameter, e.g.
+	// ?forceTransport=xhr-polling, regardless of the resource they were sent to.
+	// The requests forcing a transport that is not in Transports are refused with
+	// 400 Bad Request. This is a debugging aid for reproducing transport-specific
+	// bugs and it must not be enabled in production.
+	AllowForceTransport bool
+
+	// Validates the session ids of the incoming requests before they are looked up.
+	// The requests with an invalid session id are refused with 400 Bad Request. If
+	// nil, any session id is accepted. See IsValidSessionID.
+	ValidateSessionID func(SessionID) bool
+
+	// Answers the requests for a session id that is not established, e.g. one that
+	// was reaped while the client was offline. If nil, such requests are refused with
+	// 400 Bad Request. The 0.6 protocol has no frame telling the client to start a
+	// new session, so this is the place to answer in a way the client in use
+	// understands, e.g. with a status code it treats as a reason to handshake again.
+	OnUnknownSession func(w http.ResponseWriter, req *http.Request)
+
+	// Maximum rate of the OPTIONS preflight requests per second and client address.
+	// Each client may burst up to a second's worth of preflights, the rest are
+	// refused with 429 Too Many Requests. Zero means unlimited.
+	MaxPreflightRate int
+
+	// Maximum number of flash policy requests served concurrently by
+	// ServeFlashPolicy. The connections accepted while all the workers are busy are
+	// closed right away. Zero means unlimited.
+	FlashPolicyWorkers int
+
+	// Size in bytes of the padding html that starts the streams of the htmlfile
+	// transport. Browsers and proxies buffer the beginning of a response before
+	// rendering it, so the padding must exceed their buffers: 256 suits the
+	// browsers, but some proxies need 1024 or even 4096. Zero means 256.
+	HTMLFilePreludeSize int
+
 	// Origins to allow for cross-domain requests.
 	// For example: ["localhost:8080", "myblog.com:*"].
 	Origins []string
 
+	// Verifies the origins of the cross-domain requests instead of Origins, e.g.
+	// against an allow-list stored in a database. It is passed the raw Origin header
+	// of the request and the requests it returns false for are refused with 401
+	// Unauthorized. Origins is still used for the flash socket policy file.
+	VerifyOrigin func(origin string) bool
+
 	// Transports to use.
 	Transports []Transport
 
 	// Codec to use.
 	Codec Codec
 
-	// Logger to use.
+	// Authorizes the requests to SocketIO.StatsHandler. If nil, all the requests
+	// are authorized.
+	StatsAuth func(*http.Request) bool
+
+	// Mirrors the traffic to an external sink, e.g. for auditing. If set, it is
+	// invoked with MirrorIn for each message received from a client (the Message)
+	// and with MirrorOut for each message queued for a client with Send or any of
+	// the broadcasts. It is invoked from a separate goroutine, so a slow sink does
+	// not stall the delivery, but if it falls too far behind, the excess messages
+	// are not mirrored, see Stats.MirrorDropped. It is no longer invoked once
+	// SocketIO.Shutdown has returned and the pending messages have been mirrored.
+	Mirror func(direction int, c *Conn, data interface{})
+
+	// Reports the number of established connections, e.g. to an autoscaler. If set,
+	// it is invoked from a separate goroutine after the number has changed, at most
+	// once per ConnectionCountInterval, so a burst of connects and disconnects
+	// results in a single call with the final number.
+	OnConnectionCountChange func(count int)
+
+	// The minimum period in ns between the calls of OnConnectionCountChange.
+	ConnectionCountInterval int64
+
+	// Source of randomness for SocketIO.BroadcastSample. If nil, a source seeded with
+	// the current time is used. It must not be used elsewhere once the server has
+	// been created.
+	Rand *rand.Rand
+
+	// Resumes the panics of the OnMessage callback after they have been reported to
+	// the OnError callback, instead of letting the connection carry on. Meant for
+	// failing fast during development.
+	RePanic bool
+
+	// Logger to use. It can be replaced later with SocketIO.SetLogger.
 	Logger *log.Logger
 }
 
 var DefaultConfig = Config{
-	MaxConnections:    0,
-	QueueLength:       10,
-	ReadBufferSize:    2048,
-	HeartbeatInterval: 10e9,
-	ReconnectTimeout:  10e9,
-	Origins:           nil,
-	Transports:        DefaultTransports,
-	Codec:             SIOCodec{},
-	Logger:            DefaultLogger,
+	MaxConnections:          0,
+	AdmissionRate:           0,
+	CapacityPolicy:          Reject,
+	DuplicateSessionPolicy:  ReplaceOld,
+	QueueLength:             10,
+	MaxFramesPerPoll:        0,
+	DedupeWindow:            0,
+	DedupeAck:               false,
+	StallTimeout:            30e9,
+	TCPNoDelay:              true,
+	TCPKeepAlive:            false,
+	CloseHandshakeTimeout:   2e9,
+	MaxTagsPerConn:          0,
+	ReadBufferSize:          2048,
+	MaxPostBytes:            0,
+	HeartbeatInterval:       10e9,
+	ReconnectTimeout:        10e9,
+	ConnectionCountInterval: 1e9,
+	PollMode:                LongPoll,
+	ReplayRate:              0,
+	MaxPreflightRate:        0,
+	FlashPolicyWorkers:      0,
+	HTMLFilePreludeSize:     256,
+	Origins:                 nil,
+	Transports:              DefaultTransports,
+	Codec:                   SIOCodec{},
+	Logger:                  DefaultLogger,
 }
@@ -1,12 +1,13 @@
 package socketio
 
 import (
+	"fmt"
 	"http"
 	"os"
 	"net"
 	"bytes"
+	"runtime/debug"
 	"time"
-	"fmt"
 	"sync"
 )
 
@@ -17,31 +18,77 @@ var (
 	// ErrQueueFull is used when the send queue is full.
 	ErrQueueFull = os.NewError("send queue is full")
 
+	// ErrExpired is used when a message sent with SendTTL expired before it was written.
+	ErrExpired = os.NewError("message expired")
+
+	// ErrInvalidAnnotation is used when the metadata given to SendMeta can't be sent.
+	ErrInvalidAnnotation = os.NewError("invalid annotation")
+
 	errMissingPostData = os.NewError("Missing HTTP post data-field")
 )
 
 // Conn represents a single session and handles its handshaking,
 // message buffering and reconnections.
 type Conn struct {
-	mutex            sync.Mutex
-	socket           socket    // The i/o connection that abstract the transport.
-	sio              *SocketIO // The server.
-	sessionid        SessionID
-	online           bool
-	lastConnected    int64
-	lastDisconnected int64
-	lastHeartbeat    heartbeat
-	numHeartbeats    int
-	ticker           *time.Ticker
-	queue            chan interface{} // Buffers the outgoing messages.
-	numConns         int              // Total number of reconnects.
-	handshaked       bool             // Indicates if the handshake has been sent.
-	disconnected     bool             // Indicates if the connection has been disconnected.
-	wakeupFlusher    chan byte        // Used internally to wake up the flusher.
-	wakeupReader     chan byte        // Used internally to wake up the reader.
-	enc              Encoder
-	dec              Decoder
-	decBuf           bytes.Buffer
+	mutex             sync.Mutex
+	socket            socket    // The i/o connection that abstract the transport.
+	sio               *SocketIO // The server. Protected by sioLock, see server.
+	sioLock           sync.RWMutex
+	sessionid         SessionID
+	online            bool
+	lastConnected     int64
+	lastDisconnected  int64
+	lastHeartbeat     heartbeat
+	numHeartbeats     int
+	ticker            *time.Ticker
+	heartbeatInterval int64        // Overrides the config.HeartbeatInterval, see SetTimeouts.
+	reconnectTimeout  int64        // Overrides the config.ReconnectTimeout, see SetTimeouts.
+	queue             *sendQueue   // Buffers the outgoing messages.
+	pending           []*QueueItem // The messages left in the queue by the disconnect.
+	numConns          int          // Total number of reconnects.
+	handshaked        bool         // Indicates if the handshake has been sent.
+	disconnected      bool         // Indicates if the connection has been disconnected.
+	wakeupFlusher     chan byte    // Used internally to wake up the flusher.
+	wakeupReader      chan byte    // Used internally to wake up the reader.
+	wakeupReaper      chan byte    // Used internally to wake up the reaper when the socket is lost.
+	enc               Encoder
+	dec               Decoder
+	decBuf            bytes.Buffer
+	recvMutex         sync.Mutex      // Serializes the receives, i.e. protects dec, decBuf, seen, inbox and delivering.
+	inbox             []inboxItem     // The received messages waiting for a dispatch, see deliver.
+	delivering        bool            // Whether a goroutine is dispatching the inbox.
+	seen              *dedupeWindow   // The recently received message ids, see Config.DedupeWindow.
+	handlers          chan byte       // The slots of the concurrent handlers, see Config.MaxConcurrentHandlers.
+	request           *http.Request   // The request of the message being dispatched, see CurrentRequest.
+	tags              map[string]bool // Protected by sio.sessionsLock.
+	key               string          // The user key given to SocketIO.Register. Protected by sio.sessionsLock.
+	slot              *slot           // The slot reserved for the connection until connected. Protected by sio.sessionsLock.
+	onSendError       func(interface{}, os.Error)
+	out               []func(interface{}) interface{} // The outbound middleware.
+	replay            int                             // Number of pending messages to be replayed at ReplayRate.
+	sendRate          int                             // The outbound rate limit in bytes per second or 0.
+	tokens            int64                           // The bytes that can be written right away, see throttle.
+	tokensAt          int64                           // The time the tokens were last topped up.
+	created           int64
+
+	// The context given to SetLogContext
+	logContext struct {
+		sync.Mutex
+		s string
+	}
+
+	// The counters reported by Debug
+	counters struct {
+		sync.Mutex
+		sent, received int64
+		lastActivity   int64 // The time of the last message sent or received.
+	}
+}
+
+// InboxItem is a received message along with the request that delivered it.
+type inboxItem struct {
+	msg Message
+	req *http.Request
 }
 
 // NewConn creates a new connection for the sio. It generates the session id and
@@ -58,20 +105,98 @@ func newConn(sio *SocketIO) (c *Conn, err os.Error) {
 		sessionid:     sessionid,
 		wakeupFlusher: make(chan byte),
 		wakeupReader:  make(chan byte),
-		queue:         make(chan interface{}, sio.config.QueueLength),
+		wakeupReaper:  make(chan byte, 1),
+		queue:         newSendQueue(sio.newQueue()),
 		enc:           sio.config.Codec.NewEncoder(),
+		created:       time.Nanoseconds(),
+
+		heartbeatInterval: sio.config.HeartbeatInterval,
+		reconnectTimeout:  sio.config.ReconnectTimeout,
 	}
 
 	c.dec = sio.config.Codec.NewDecoder(&c.decBuf)
+	if sio.config.MaxConcurrentHandlers > 1 {
+		c.handlers = make(chan byte, sio.config.MaxConcurrentHandlers)
+	}
 
 	return
 }
 
 
+// Server returns the server the connection belongs to. It changes when the
+// connection is adopted by another server, see SocketIO.Adopt.
+func (c *Conn) server() *SocketIO {
+	c.sioLock.RLock()
+	defer c.sioLock.RUnlock()
+
+	return c.sio
+}
+
+// LockSessions locks the sessionsLock of the server the connection belongs to, for
+// writing if write is set, and returns the server. The connection can't be adopted
+// by another server while the lock is held.
+func (c *Conn) lockSessions(write bool) *SocketIO {
+	for {
+		sio := c.server()
+		if write {
+			sio.sessionsLock.Lock()
+		} else {
+			sio.sessionsLock.RLock()
+		}
+
+		if c.server() == sio {
+			return sio
+		}
+
+		if write {
+			sio.sessionsLock.Unlock()
+		} else {
+			sio.sessionsLock.RUnlock()
+		}
+	}
+
+	return nil
+}
+
 // String returns a string representation of the connection and implements the
-// fmt.Stringer interface.
+// fmt.Stringer interface. The representation is the session id of the connection.
+// It does not change during the lifetime of the connection, e.g. when the client
+// switches to another transport, so it is safe to be used as a display or map key.
 func (c *Conn) String() string {
-	return fmt.Sprintf("%v[%v]", c.sessionid, c.socket)
+	return string(c.sessionid)
+}
+
+// SetLogContext sets the context that is logged along with the session id in the log
+// lines of this connection, e.g. the correlation id of the application.
+func (c *Conn) SetLogContext(context string) {
+	c.logContext.Lock()
+	c.logContext.s = context
+	c.logContext.Unlock()
+}
+
+// Log logs v through the logger of the server like SocketIO.Log, prefixed with the
+// session id and the context of the connection, see SetLogContext. All the log lines
+// of the connection itself are logged through Log, so grepping for the session id
+// reveals the whole lifecycle of the connection.
+func (c *Conn) Log(v ...interface{}) {
+	c.server().Log(append([]interface{}{c.logPrefix()}, v...)...)
+}
+
+// Logf logs the formatted v through the logger of the server like SocketIO.Logf,
+// prefixed like Log.
+func (c *Conn) Logf(format string, v ...interface{}) {
+	c.server().Log(c.logPrefix(), fmt.Sprintf(format, v...))
+}
+
+// LogPrefix returns the prefix of the log lines of the connection.
+func (c *Conn) logPrefix() string {
+	c.logContext.Lock()
+	defer c.logContext.Unlock()
+
+	if c.logContext.s == "" {
+		return "sio/conn[" + string(c.sessionid) + "]:"
+	}
+	return "sio/conn[" + string(c.sessionid) + " " + c.logContext.s + "]:"
 }
 
 // Send queues data for a delivery. It is totally content agnostic with one exception:
@@ -80,18 +205,230 @@ func (c *Conn) String() string {
 // has reached sio.config.QueueLength or the connection has been disconnected,
 // then the data is dropped and a an error is returned.
 func (c *Conn) Send(data interface{}) os.Error {
-	if ok := c.queue <- data; !ok {
-		if closed(c.queue) {
-			return ErrDestroyed
+	return c.push(&QueueItem{Data: data})
+}
+
+// SendMeta queues data for a delivery just like Send, but along with the metadata in
+// meta. The metadata is sent next to the payload, so the client can read it without
+// touching the payload itself. SIOCodec sends it as the annotations of the message,
+// which means that the keys and the values can't contain colons or newlines, and
+// that the key "j" is reserved: such metadata is refused with ErrInvalidAnnotation.
+// The inbound annotations are available through Message.Annotations. Codecs that
+// don't support annotations omit the metadata.
+func (c *Conn) SendMeta(data interface{}, meta map[string]string) os.Error {
+	for key, value := range meta {
+		if !validAnnotation(key, value) {
+			return ErrInvalidAnnotation
 		}
+	}
+	return c.Send(annotated{data, meta})
+}
+
+// SendPriority queues data for a delivery just like Send, but the messages with a
+// higher priority are delivered before the pending messages with a lower priority.
+// The messages of equal priority are delivered in the order they were sent. Send
+// uses the priority 0.
+func (c *Conn) SendPriority(data interface{}, priority int) os.Error {
+	return c.push(&QueueItem{Data: data, Priority: priority})
+}
+
+// SendKeyed queues data for a delivery just like Send, but tags it with the given key.
+// If the tail-most message still waiting in the queue was sent with the same key, it is
+// replaced by data instead of appending a new message. This is opt-in and meant for
+// collapsing redundant state updates for slow clients: only adjacent messages sharing
+// a key are coalesced, so the ordering of differently-keyed messages is never affected.
+// An empty key behaves exactly like Send.
+func (c *Conn) SendKeyed(key string, data interface{}) os.Error {
+	return c.push(&QueueItem{Data: data, Key: key})
+}
+
+// SendBatch queues the messages in datas for a delivery as a group: either all of
+// them are queued, in order, or none of them is, e.g. if there is no room for all of
+// them in the send queue. It is the way to send the messages that only make sense
+// together. With config.NewQueue, the queue must accept config.QueueLength messages
+// for the guarantee to hold.
+func (c *Conn) SendBatch(datas []interface{}) os.Error {
+	items := make([]*QueueItem, len(datas))
+	for i, data := range datas {
+		items[i] = &QueueItem{Data: data}
+	}
+
+	if err := c.queue.pushAll(items, c.server().config.QueueLength); err != nil {
+		if err == ErrQueueFull {
+			c.server().onOverflow(c, len(items))
+		}
+		return err
+	}
+
+	for _, data := range datas {
+		c.mirrorOut(data)
+	}
+	return nil
+}
 
-		return ErrQueueFull
+// SendTTL queues data for a delivery just like Send, but the message expires if it
+// has not been written within ttl ns, e.g. because the client is reconnecting. The
+// expired messages are dropped instead of being delivered late and they are passed
+// to the OnSendError callback with ErrExpired.
+func (c *Conn) SendTTL(data interface{}, ttl int64) os.Error {
+	return c.push(&QueueItem{Data: data, Expires: time.Nanoseconds() + ttl})
+}
+
+// Push queues item and mirrors it, see Config.Mirror. If the queue is full, the
+// item is dropped and reported to the OnOverflow callback.
+func (c *Conn) push(item *QueueItem) os.Error {
+	if err := c.queue.push(item); err != nil {
+		if err == ErrQueueFull {
+			c.server().onOverflow(c, 1)
+		}
+		return err
 	}
 
+	c.mirrorOut(item.Data)
 	return nil
 }
 
+// MirrorOut mirrors the queued data, see Config.Mirror. The internal messages are
+// not mirrored.
+func (c *Conn) mirrorOut(data interface{}) {
+	if data, ok := userData(data); ok {
+		c.server().mirror(MirrorOut, c, data)
+	}
+}
+
+// Transport returns the transport of the live socket or nil if there isn't one.
+func (c *Conn) transport() Transport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.online || c.disconnected {
+		return nil
+	}
+	return c.socket.Transport()
+}
+
+// Polling reports whether the connection is bound to a socket of a polling transport.
+func (c *Conn) polling() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.socket != nil && isPolling(c.socket.Transport())
+}
+
+// OnSendError sets f to be invoked for each queued message that could not be
+// delivered to this connection, e.g. because it could not be encoded or because the
+// connection was disconnected before the message was written. It passes the original
+// data given to Send along with the reason.
+func (c *Conn) OnSendError(f func(data interface{}, err os.Error)) {
+	c.mutex.Lock()
+	c.onSendError = f
+	c.mutex.Unlock()
+}
+
+// UseOut adds f to the chain of outbound middleware of this connection. Right before
+// a message sent to this connection is encoded, it is passed through the chain in
+// the order the middleware was added and the value returned by the last one is
+// encoded instead. This applies to the broadcasts as well, so it can be used for
+// per-connection transformations, e.g. for redacting fields by role. The heartbeats
+// and the other internal messages are not passed through the chain.
+func (c *Conn) UseOut(f func(data interface{}) interface{}) {
+	c.mutex.Lock()
+	c.out = append(c.out, f)
+	c.mutex.Unlock()
+}
+
+// Outbound passes data through the outbound middleware chain out.
+func outbound(out []func(interface{}) interface{}, data interface{}) interface{} {
+	switch t := data.(type) {
+	case heartbeat, handshake, disconnect, ack:
+		return data
+
+	case annotated:
+		t.data = outbound(out, t.data)
+		return t
+	}
+
+	for _, f := range out {
+		data = f(data)
+	}
+	return data
+}
+
+// SendFailed passes the data of the undeliverable items to the user's OnSendError
+// callback and, if the connection has been disconnected, to the OnDeadLetter callback.
+// The internal messages are skipped.
+func (c *Conn) sendFailed(items []*QueueItem, err os.Error) {
+	c.mutex.Lock()
+	f := c.onSendError
+	c.mutex.Unlock()
+
+	for _, item := range items {
+		data, ok := userData(item.Data)
+		if !ok {
+			continue
+		}
+		if f != nil {
+			f(data, err)
+		}
+		if err == ErrDestroyed {
+			c.server().onDeadLetter(c.sessionid, data)
+		}
+	}
+}
+
+// UserData unwraps the data given to Send from a queued message. It returns false
+// for the internal messages.
+func userData(data interface{}) (interface{}, bool) {
+	switch t := data.(type) {
+	case heartbeat, handshake, disconnect, ack:
+		return nil, false
+
+	case annotated:
+		return t.data, true
+	}
+	return data, true
+}
+
+// PendingMessages returns the messages that were still queued for the connection
+// when it was disconnected, i.e. the data given to Send that was never written,
+// e.g. to deliver it by other means from the OnDisconnect callback. It returns nil
+// while the connection is established, and the internal messages are skipped.
+func (c *Conn) PendingMessages() (pending []interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, item := range c.pending {
+		if data, ok := userData(item.Data); ok {
+			pending = append(pending, data)
+		}
+	}
+	return
+}
+
+// PendingItems returns the items left in the queue by the disconnect.
+func (c *Conn) pendingItems() []*QueueItem {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.pending
+}
+
+// Connected reports whether the connection currently has a live socket bound to it.
+func (c *Conn) Connected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.online && !c.disconnected
+}
+
+// Close closes the connection: the farewell of the OnClosing callback is written
+// to the socket, the socket is closed and the OnDisconnect callback is invoked.
+// Close does not wait for the goroutines serving the connection to exit, so it is
+// safe to call from within the callbacks, including the OnMessage callback of this
+// very connection. It returns ErrNotConnected if the connection has already been
+// disconnected.
 func (c *Conn) Close() os.Error {
+	data := c.closing()
 	c.mutex.Lock()
 
 	if c.disconnected {
@@ -99,13 +436,31 @@ func (c *Conn) Close() os.Error {
 		return ErrNotConnected
 	}
 
+	c.farewell(data)
 	c.disconnect()
 	c.mutex.Unlock()
 
-	c.sio.onDisconnect(c)
+	c.server().onDisconnect(c)
 	return nil
 }
 
+// Flush waits until all the queued messages have been written to the socket or
+// the deadline (in ns) has passed. It returns false if the deadline was reached.
+func (c *Conn) flush(deadline int64) bool {
+	for {
+		idle, closed := c.queue.status()
+		if idle || closed {
+			return idle && !closed
+		}
+		if time.Nanoseconds() >= deadline {
+			return false
+		}
+		time.Sleep(10e6)
+	}
+
+	return false
+}
+
 // Handle takes over an http responseWriter/req -pair using the given Transport.
 // If the HTTP method is POST then request's data-field will be used as an incoming
 // message and the request is dropped. If the method is GET then a new socket encapsulating
@@ -113,38 +468,53 @@ func (c *Conn) Close() os.Error {
 // reconnected). Finally, handle will wake up the reader and the flusher.
 func (c *Conn) handle(t Transport, w http.ResponseWriter, req *http.Request) (err os.Error) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
 
 	if c.disconnected {
+		c.mutex.Unlock()
 		return ErrNotConnected
 	}
 
 	if req.Method == "POST" {
+		// the callbacks invoked by receive may use the connection
+		c.mutex.Unlock()
+
 		if msg := req.FormValue("data"); msg != "" {
 			w.SetHeader("Content-Type", "text/plain")
 			w.Write(okResponse)
-			c.receive([]byte(msg))
+			c.receiveRequest([]byte(msg), req)
 		} else {
-			c.sio.Log("sio/conn: handle: POST missing data-field:", c)
+			c.Log("handle: POST missing data-field")
 			return errMissingPostData
 		}
 
 		return
 	}
 
-	s := t.newSocket()
+	defer c.mutex.Unlock()
+
+	if c.online && c.server().config.DuplicateSessionPolicy == RejectNew {
+		return ErrConnected
+	}
+
+	s := t.newSocket(&c.server().config)
 	err = s.accept(w, req, func() {
+		var from Transport
 		if c.socket != nil {
+			from = c.socket.Transport()
 			c.socket.Close()
 		}
+		now := time.Nanoseconds()
+		// a poll reconnects right after the previous one, so only a longer gap
+		// means that the client has been away
+		away := !c.online && now-c.lastDisconnected > c.heartbeatInterval
 		c.socket = s
 		c.online = true
-		c.lastConnected = time.Nanoseconds()
+		c.lastConnected = now
 
 		if !c.handshaked {
 			// the connection has not been handshaked yet.
 			if err = c.handshake(); err != nil {
-				c.sio.Log("sio/conn: handle/handshake:", err, c)
+				c.Log("handle/handshake:", err)
 				c.socket.Close()
 				return
 			}
@@ -154,12 +524,23 @@ func (c *Conn) handle(t Transport, w http.ResponseWriter, req *http.Request) (er
 			go c.keepalive()
 			go c.flusher()
 			go c.reader()
-			defer c.sio.onConnect(c)
+			go c.reaper()
+			defer c.server().onConnect(c)
 			defer c.mutex.Unlock()
 
-			c.sio.Log("sio/conn: connected:", c)
+			c.Log("connected")
 		} else {
-			c.sio.Log("sio/conn: reconnected:", c)
+			c.Log("reconnected")
+			if from != nil && from.Resource() != t.Resource() {
+				go c.server().onUpgrade(c, from, t)
+			}
+			if away && c.server().config.ReplayRate > 0 {
+				c.replay = c.queue.Len()
+			}
+			if idle, _ := c.queue.status(); idle && isPolling(t) && c.server().config.PollMode == ShortPoll {
+				// nothing to deliver, so end the poll right away
+				c.socket.Write(emptyResponse)
+			}
 		}
 
 		c.numConns++
@@ -176,41 +557,298 @@ func (c *Conn) handshake() os.Error {
 }
 
 
+// Closing invokes the user's OnClosing callback, if the connection has a live socket,
+// and returns the farewell message or nil. It must be called without c.mutex held,
+// so that the callback can use the connection.
+func (c *Conn) closing() interface{} {
+	if !c.Connected() {
+		return nil
+	}
+	return c.server().onClosing(c)
+}
+
+// Farewell writes the message returned by closing straight to the socket, bypassing
+// the queue, so that it gets delivered before the socket is closed. Nothing is written
+// if the socket has already been lost. It must be called with c.mutex held.
+func (c *Conn) farewell(data interface{}) {
+	if !c.online || data == nil {
+		return
+	}
+
+	// the flusher owns c.enc, so use a fresh encoder
+	buf := new(bytes.Buffer)
+	if err := c.server().config.Codec.NewEncoder().Encode(buf, data); err != nil {
+		c.Log("farewell/encode:", err)
+		return
+	}
+	if _, err := buf.WriteTo(c.socket); err != nil {
+		c.Log("farewell/write:", err)
+	}
+}
+
 func (c *Conn) disconnect() {
-	c.sio.Log("sio/conn: disconnected:", c)
+	c.Log("disconnected")
 	c.socket.Close()
 	c.disconnected = true
 	close(c.wakeupFlusher)
 	close(c.wakeupReader)
-	close(c.queue)
+	close(c.wakeupReaper)
+	c.queue.close()
+	c.pending = c.queue.drain()
 }
 
 // Receive decodes and handles data received from the socket.
 // It uses c.sio.codec to decode the data. The received non-heartbeat
 // messages (frames) are then passed to c.sio.onMessage method and the
-// heartbeats are processed right away (TODO).
+// heartbeats are processed right away (TODO). A disconnect message closes
+// the connection and the rest of the messages are ignored. Data that can't be
+// decoded is reported to the OnError callback and closes the connection.
 func (c *Conn) receive(data []byte) {
+	c.receiveRequest(data, nil)
+}
+
+// ReceiveRequest receives data just like receive, but data was delivered by the
+// request req, which is available to the handlers through CurrentRequest.
+func (c *Conn) receiveRequest(data []byte, req *http.Request) {
+	// without the lock, so the tap may use the receiving path, e.g. Inject
+	c.server().onRaw(c.server().callbacks.onRawIn, c, data)
+
+	c.recvMutex.Lock()
 	c.decBuf.Write(data)
 	msgs, err := c.dec.Decode()
+	if err == nil {
+		for _, m := range msgs {
+			// the handshakes are sent by the server only
+			if m.Type() == MessageHandshake {
+				err = ErrMalformedPayload
+				break
+			}
+		}
+	}
 	if err != nil {
-		c.sio.Log("sio/conn: receive/decode:", err, c)
+		c.recvMutex.Unlock()
+		c.Log("receive/decode:", err)
+		c.server().onError(c, err, nil)
+		c.Close()
 		return
 	}
 
+	c.countReceived(len(msgs))
+
 	for _, m := range msgs {
-		if hb, ok := m.heartbeat(); ok {
-			c.lastHeartbeat = hb
+		if !c.process(m, req) {
+			break
+		}
+	}
+	c.recvMutex.Unlock()
+
+	c.deliver()
+}
+
+// CurrentRequest returns the http request that delivered the message being handled,
+// e.g. to read its headers in the OnMessage callback. It is only valid during the
+// OnMessage callback of that message. It returns nil for the messages received
+// through a persistent socket like websocket, which has no request per message, and
+// always when config.MaxConcurrentHandlers is above 1.
+func (c *Conn) CurrentRequest() *http.Request {
+	if c.handlers != nil {
+		return nil
+	}
+	return c.request
+}
+
+// Inject passes msg through the inbound path of the connection as if it had been
+// received from the client, e.g. a message relayed from another connection or
+// decoded from an external source. The OnMessage callback and the deduplication of
+// config.DedupeWindow apply as usual, but msg is not counted in the statistics and
+// it is not passed to the OnRawInbound callback, since it has no raw form.
+//
+// Usually msg has been handled by the time Inject returns. If the connection is in
+// the middle of handling its messages, e.g. when Inject is called from an OnMessage
+// callback of the connection, msg is handled after them instead and Inject returns
+// right away. So it is safe to inject messages from within the callbacks, also back
+// and forth between two bridged connections.
+func (c *Conn) Inject(msg Message) {
+	c.recvMutex.Lock()
+	c.process(msg, nil)
+	c.recvMutex.Unlock()
+
+	c.deliver()
+}
+
+// Process handles a single inbound message that was delivered by the request req.
+// The heartbeats are handled right away and the rest of the messages are put in the
+// inbox, unless they are duplicates, see deliver. It returns false if the client has
+// disconnected, i.e. the following messages must be ignored. It must be called with
+// c.recvMutex held.
+func (c *Conn) process(m Message, req *http.Request) bool {
+	if hb, ok := m.heartbeat(); ok {
+		c.lastHeartbeat = hb
+	} else if m.Type() == MessageDisconnect {
+		c.inbox = append(c.inbox, inboxItem{m, req})
+		return false
+	} else if !c.duplicate(m) {
+		c.inbox = append(c.inbox, inboxItem{m, req})
+	}
+	return true
+}
+
+// Deliver dispatches the messages of the inbox in order, until the inbox is empty.
+// If another goroutine is delivering them already, e.g. the one running the OnMessage
+// callback that called Inject, deliver leaves the messages to that goroutine and
+// returns right away. The callbacks are invoked without c.recvMutex held.
+func (c *Conn) deliver() {
+	c.recvMutex.Lock()
+	if c.delivering {
+		c.recvMutex.Unlock()
+		return
+	}
+	c.delivering = true
+	c.recvMutex.Unlock()
+
+	done := false
+	defer func() {
+		if !done {
+			// a callback panicked, see config.RePanic
+			c.recvMutex.Lock()
+			c.delivering = false
+			c.recvMutex.Unlock()
+		}
+	}()
+
+	for {
+		c.recvMutex.Lock()
+		if len(c.inbox) == 0 {
+			c.delivering = false
+			c.recvMutex.Unlock()
+			done = true
+			return
+		}
+		in := c.inbox[0]
+		c.inbox = c.inbox[1:]
+		c.recvMutex.Unlock()
+
+		if in.msg.Type() == MessageDisconnect {
+			c.clientClose()
 		} else {
-			c.sio.onMessage(c, m)
+			c.dispatchAsync(in.msg, in.req)
 		}
 	}
 }
 
+// DispatchAsync dispatches msg in a goroutine of its own, if config.MaxConcurrentHandlers
+// allows more than one handler at a time. It blocks while all the handlers are busy,
+// which stops the connection from receiving more messages. Otherwise it dispatches msg
+// right away, along with the request req that delivered it, see CurrentRequest.
+func (c *Conn) dispatchAsync(msg Message, req *http.Request) {
+	if c.handlers == nil {
+		c.request = req
+		c.dispatch(msg)
+		c.request = nil
+		return
+	}
+
+	c.handlers <- 1
+	go func() {
+		defer func() { <-c.handlers }()
+		c.dispatch(msg)
+	}()
+}
+
+// ClientClose disconnects the connection right away on the client's request, i.e.
+// when the client has sent a disconnect message. The client is leaving, so nothing
+// is written to the socket anymore.
+func (c *Conn) clientClose() {
+	c.mutex.Lock()
+
+	if c.disconnected {
+		c.mutex.Unlock()
+		return
+	}
+
+	c.Log("disconnected by the client")
+	c.disconnect()
+	c.mutex.Unlock()
+
+	c.server().onDisconnect(c)
+}
+
+// Dispatch passes msg to the user's OnMessage callback. The messages sent to this
+// connection during the callback are held back and flushed together once the
+// callback returns, unless the callback calls NoBatch. The heartbeats are not held
+// back, so a slow callback doesn't get the connection timed out. A panic of the
+// callback is recovered, see SocketIO.OnError.
+func (c *Conn) dispatch(msg Message) {
+	c.queue.hold()
+	defer c.queue.release()
+	defer c.recoverPanic()
+
+	c.server().mirror(MirrorIn, c, msg)
+	c.server().onMessage(c, msg)
+}
+
+// RecoverPanic recovers from a panic of the user's OnMessage callback and reports it to
+// the user's OnError callback. If c.sio.config.RePanic is set, the panic is resumed.
+// It must be deferred.
+func (c *Conn) recoverPanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	c.Logf("OnMessage panicked: %v\n%s", v, stack)
+	c.server().onError(c, v, stack)
+
+	if c.server().config.RePanic {
+		panic(v)
+	}
+}
+
+// NoBatch is meant to be called from within the OnMessage callback of this connection.
+// By default the messages sent to the connection during the callback are collected
+// and delivered together after the callback returns. NoBatch opts out of that for
+// the rest of the callback: the messages sent so far are flushed right away and the
+// following ones are delivered as usual. With config.MaxConcurrentHandlers above 1,
+// the messages are held back until all the running callbacks have returned, and
+// NoBatch opts out for all of them, since the messages are not told apart by the
+// callback that sent them.
+func (c *Conn) NoBatch() {
+	c.queue.lift()
+}
+
+// SetTimeouts overrides the heartbeat interval and the reconnect timeout (in ns) of
+// the config for this connection, e.g. to send the heartbeats less often to a
+// battery-constrained device. The heartbeat interval takes effect after the next
+// heartbeat. A zero value leaves the corresponding timeout unchanged.
+func (c *Conn) SetTimeouts(heartbeatInterval, reconnectTimeout int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if heartbeatInterval > 0 {
+		c.heartbeatInterval = heartbeatInterval
+	}
+	if reconnectTimeout > 0 {
+		c.reconnectTimeout = reconnectTimeout
+	}
+}
+
+// Timeouts returns the heartbeat interval and the reconnect timeout (in ns) of this
+// connection, see SetTimeouts.
+func (c *Conn) Timeouts() (heartbeatInterval, reconnectTimeout int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.heartbeatInterval, c.reconnectTimeout
+}
+
 func (c *Conn) keepalive() {
-	c.ticker = time.NewTicker(c.sio.config.HeartbeatInterval)
-	defer c.ticker.Stop()
+	heartbeatInterval, _ := c.Timeouts()
+	c.ticker = time.NewTicker(heartbeatInterval)
+	defer func() { c.ticker.Stop() }()
 
-	for t := range c.ticker.C {
+	for {
+		t := <-c.ticker.C
 		c.mutex.Lock()
 
 		if c.disconnected {
@@ -218,24 +856,177 @@ func (c *Conn) keepalive() {
 			return
 		}
 
-		if (!c.online && t-c.lastDisconnected > c.sio.config.ReconnectTimeout) || int(c.lastHeartbeat) < c.numHeartbeats {
+		if (!c.online && t-c.lastDisconnected > c.reconnectTimeout) || int(c.lastHeartbeat) < c.numHeartbeats {
+			c.mutex.Unlock()
+			data := c.closing()
+
+			c.mutex.Lock()
+			if c.disconnected {
+				c.mutex.Unlock()
+				return
+			}
+			c.farewell(data)
 			c.disconnect()
 			c.mutex.Unlock()
 			break
 		}
 
 		c.numHeartbeats++
-		if ok := c.queue <- heartbeat(c.numHeartbeats); !ok {
-			c.sio.Log("sio/keepalive: unable to queue heartbeat. fail now. TODO: FIXME", c)
+		if err := c.queue.push(&QueueItem{Data: heartbeat(c.numHeartbeats)}); err != nil {
+			// the callbacks invoked by onOverflow may use the connection
+			c.mutex.Unlock()
+			if err == ErrQueueFull {
+				c.server().onOverflow(c, 1)
+			}
+
+			c.mutex.Lock()
+			if c.disconnected {
+				c.mutex.Unlock()
+				return
+			}
+			c.Log("keepalive: unable to queue heartbeat:", err)
 			c.disconnect()
 			c.mutex.Unlock()
 			break
 		}
 
+		if c.heartbeatInterval != heartbeatInterval {
+			heartbeatInterval = c.heartbeatInterval
+			c.ticker.Stop()
+			c.ticker = time.NewTicker(heartbeatInterval)
+		}
+
+		c.mutex.Unlock()
+	}
+
+	c.server().onDisconnect(c)
+}
+
+// Reaper disconnects the connection once it has been without a socket for the
+// reconnect timeout. It is woken up by the reader each time the socket is lost and
+// it serves the connection until the c.wakeupReaper is closed, so a polling client
+// that loses its socket on every poll is watched by this single goroutine.
+func (c *Conn) reaper() {
+	for {
+		<-c.wakeupReaper
+		if closed(c.wakeupReaper) {
+			return
+		}
+
+		for wait := c.reap(); wait > 0; wait = c.reap() {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// Reap disconnects the connection if it has been without a socket for the reconnect
+// timeout. Otherwise it returns the time (in ns) left until the timeout, or 0 if the
+// connection is online or has been disconnected already.
+func (c *Conn) reap() (wait int64) {
+	c.mutex.Lock()
+	if c.disconnected || c.online {
+		c.mutex.Unlock()
+		return 0
+	}
+
+	if wait = c.lastDisconnected + c.reconnectTimeout - time.Nanoseconds(); wait > 0 {
+		c.mutex.Unlock()
+		return wait
+	}
+
+	c.Log("reconnect timeout")
+	c.disconnect()
+	c.mutex.Unlock()
+
+	c.server().onDisconnect(c)
+	return 0
+}
+
+// Replaying reports whether the next message to be flushed is one of the messages
+// that were pending when the connection was reconnected, and hence subject to the
+// c.sio.config.ReplayRate.
+func (c *Conn) replaying() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.replay > 0 {
+		c.replay--
+		return true
+	}
+	return false
+}
+
+// SetSendRate limits the rate at which the messages are written to this connection to
+// bytesPerSec bytes per second, e.g. for clients with a capped bandwidth. The messages
+// are paced, not dropped: the ones exceeding the rate wait in the queue, so the queue
+// fills up if the rate is exceeded for long. Bursts of up to a second worth of bytes
+// are let through right away. Zero means unlimited.
+func (c *Conn) SetSendRate(bytesPerSec int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.sendRate = bytesPerSec
+	c.tokens = int64(bytesPerSec)
+	c.tokensAt = time.Nanoseconds()
+}
+
+// Throttled reports whether the send rate of the connection is limited.
+func (c *Conn) throttled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.sendRate > 0
+}
+
+// Throttle implements the token bucket behind SetSendRate. It takes n bytes worth
+// of tokens and sleeps until the bucket is no longer in debt. The bucket holds at
+// most a second worth of tokens.
+func (c *Conn) throttle(n int) {
+	c.mutex.Lock()
+
+	rate := int64(c.sendRate)
+	if rate <= 0 {
 		c.mutex.Unlock()
+		return
+	}
+
+	now := time.Nanoseconds()
+	if elapsed := now - c.tokensAt; elapsed >= 1e9 {
+		c.tokens = rate
+	} else if c.tokens += elapsed * rate / 1e9; c.tokens > rate {
+		c.tokens = rate
+	}
+	c.tokensAt = now
+	c.tokens -= int64(n)
+
+	var wait int64
+	if c.tokens < 0 {
+		wait = -c.tokens * 1e9 / rate
+	}
+	c.mutex.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Expire drops the expired items of the popped items and returns the rest.
+func (c *Conn) expire(items []*QueueItem) []*QueueItem {
+	now := time.Nanoseconds()
+	var live, expired []*QueueItem
+	for _, item := range items {
+		if item.Expires != 0 && now > item.Expires {
+			expired = append(expired, item)
+		} else {
+			live = append(live, item)
+		}
 	}
 
-	c.sio.onDisconnect(c)
+	if expired != nil {
+		c.queue.done(len(expired))
+		c.sendFailed(expired, ErrExpired)
+	}
+	return live
 }
 
 // Flusher waits for messages on the queue. It then
@@ -251,32 +1042,50 @@ func (c *Conn) keepalive() {
 func (c *Conn) flusher() {
 	buf := new(bytes.Buffer)
 	var err os.Error
-	var msg interface{}
-	var ok bool
-	var n int
+	var items []*QueueItem
 
-	for msg = range c.queue {
-		buf.Reset()
-		err = c.enc.Encode(buf, msg)
-		n = 1
+	for {
+		n := c.server().config.QueueLength
+		if max := c.server().config.MaxFramesPerPoll; max > 0 && max < n && c.polling() {
+			n = max
+		}
+		replaying := c.replaying()
+		if replaying || c.throttled() {
+			n = 1
+		}
 
-		if err == nil {
-			for n < c.sio.config.QueueLength {
-				if msg, ok = <-c.queue; !ok {
-					break
-				}
-				n++
+		if items = c.queue.pop(n); items == nil {
+			c.sendFailed(c.pendingItems(), ErrDestroyed)
+			return
+		}
+		if items = c.expire(items); len(items) == 0 {
+			continue
+		}
 
-				if err = c.enc.Encode(buf, msg); err != nil {
-					break
-				}
+		c.mutex.Lock()
+		out := c.out
+		c.mutex.Unlock()
+
+		buf.Reset()
+		for _, item := range items {
+			data := item.Data
+			if out != nil {
+				data = outbound(out, data)
+			}
+			if err = c.enc.Encode(buf, data); err != nil {
+				break
 			}
 		}
 		if err != nil {
-			c.sio.Logf("sio/conn: flusher/encode: lost %d messages (%d bytes): %s %s", n, buf.Len(), err, c)
+			c.Logf("flusher/encode: lost %d messages (%d bytes): %s", len(items), buf.Len(), err)
+			c.queue.done(len(items))
+			c.sendFailed(items, err)
 			continue
 		}
 
+		c.server().onRaw(c.server().callbacks.onRawOut, c, buf.Bytes())
+		c.throttle(buf.Len())
+
 	L:
 		for {
 			for {
@@ -285,6 +1094,11 @@ func (c *Conn) flusher() {
 				c.mutex.Unlock()
 
 				if err == nil {
+					c.queue.done(len(items))
+					c.countSent(len(items))
+					if replaying {
+						time.Sleep(1e9 / int64(c.server().config.ReplayRate))
+					}
 					break L
 				} else if err != os.EAGAIN {
 					break
@@ -293,6 +1107,8 @@ func (c *Conn) flusher() {
 
 			<-c.wakeupFlusher
 			if closed(c.wakeupFlusher) {
+				c.queue.done(len(items))
+				c.sendFailed(append(items, c.pendingItems()...), ErrDestroyed)
 				return
 			}
 		}
@@ -305,7 +1121,7 @@ func (c *Conn) flusher() {
 // call the c.disconnect method and start waiting for the next event on the
 // c.wakeupReader channel.
 func (c *Conn) reader() {
-	buf := make([]byte, c.sio.config.ReadBufferSize)
+	buf := make([]byte, c.server().config.ReadBufferSize)
 
 	for {
 		c.mutex.Lock()
@@ -317,10 +1133,10 @@ func (c *Conn) reader() {
 			if err != nil {
 				if err != os.EAGAIN {
 					if neterr, ok := err.(*net.OpError); ok && neterr.Timeout() {
-						c.sio.Log("sio/conn: lost connection (timeout):", c)
+						c.Log("lost connection (timeout)")
 						socket.Write(emptyResponse)
 					} else {
-						c.sio.Log("sio/conn: lost connection:", c)
+						c.Log("lost connection")
 					}
 					break
 				}
@@ -334,8 +1150,9 @@ func (c *Conn) reader() {
 		c.mutex.Lock()
 		c.lastDisconnected = time.Nanoseconds()
 		socket.Close()
-		if c.socket == socket {
+		if c.socket == socket && !c.disconnected {
 			c.online = false
+			_ = c.wakeupReaper <- 1
 		}
 		c.mutex.Unlock()
 
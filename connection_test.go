@@ -0,0 +1,1031 @@
+package socketio
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSocket is a socket that writes to a buffer.
+type testSocket struct {
+	bytes.Buffer
+	closed bool
+	t      Transport
+}
+
+func (s *testSocket) String() string {
+	return "test"
+}
+
+// Read reports the end of the stream, i.e. the client never sends anything.
+func (s *testSocket) Read(p []byte) (int, os.Error) {
+	return 0, os.EOF
+}
+
+func (s *testSocket) Transport() Transport {
+	return s.t
+}
+
+func (s *testSocket) accept(w http.ResponseWriter, req *http.Request, proceed func()) os.Error {
+	proceed()
+	return nil
+}
+
+func (s *testSocket) Close() os.Error {
+	s.closed = true
+	return nil
+}
+
+// TestTransport is a transport of testSockets.
+type testTransport string
+
+func (t testTransport) Resource() string {
+	return string(t)
+}
+
+func (t testTransport) newSocket(config *Config) socket {
+	return &testSocket{t: t}
+}
+
+// NewTestConn creates an established connection bound to a testSocket.
+func newTestConn(t *testing.T, sio *SocketIO) *Conn {
+	c, err := newConn(sio)
+	if err != nil {
+		t.Fatal("newConn:", err)
+	}
+	c.socket = new(testSocket)
+	c.online = true
+	c.handshaked = true
+	sio.onConnect(c)
+	return c
+}
+
+// WaitWritten waits until expect has been written to the testSocket of c.
+func waitWritten(t *testing.T, c *Conn, expect string) {
+	socket := c.socket.(*testSocket)
+	start := time.Nanoseconds()
+
+	for {
+		c.mutex.Lock()
+		written := socket.Buffer.String()
+		c.mutex.Unlock()
+
+		if written == expect {
+			return
+		}
+		if time.Nanoseconds()-start > 5e9 {
+			t.Fatalf("Expected %q but got %q", expect, written)
+		}
+		time.Sleep(1e6)
+	}
+}
+
+func TestReap(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.ReconnectTimeout = 50e6
+	sio := NewSocketIO(&config)
+	disconnected := make(chan *Conn, 2)
+	sio.OnDisconnect(func(c *Conn) {
+		disconnected <- c
+	})
+
+	lose := func(c *Conn) {
+		c.mutex.Lock()
+		c.online = false
+		c.lastDisconnected = time.Nanoseconds()
+		_ = c.wakeupReaper <- 1
+		c.mutex.Unlock()
+	}
+	reconnect := func(c *Conn) {
+		c.mutex.Lock()
+		c.online = true
+		c.mutex.Unlock()
+	}
+
+	// reconnected within the timeout
+	c := newTestConn(t, sio)
+	go c.reaper()
+	lose(c)
+	reconnect(c)
+
+	time.Sleep(2 * config.ReconnectTimeout)
+	if _, ok := <-disconnected; ok || sio.GetConn(c.sessionid) != c {
+		t.Fatal("Did not expect a reconnected connection to be reaped")
+	}
+
+	// lost again, the timeout counts from the last loss
+	lose(c)
+	time.Sleep(30e6)
+	reconnect(c)
+	lose(c)
+	time.Sleep(30e6)
+	if _, ok := <-disconnected; ok {
+		t.Fatal("Did not expect the connection to be reaped before the timeout of the last loss")
+	}
+
+	time.Sleep(2 * config.ReconnectTimeout)
+	if d, ok := <-disconnected; !ok || d != c || sio.GetConn(c.sessionid) != nil {
+		t.Fatal("Expected the connection to be reaped")
+	}
+}
+
+func TestReplayRate(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.ReplayRate = 50
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+
+	for i := 0; i < 5; i++ {
+		c.Send(i)
+	}
+	c.replay = c.queue.Len()
+	c.Send("live")
+
+	expect := ""
+	for i := 0; i < 5; i++ {
+		expect += frame(fmt.Sprint(i), 1, false)
+	}
+	expect += frame("live", 1, false)
+
+	start := time.Nanoseconds()
+	go c.flusher()
+	waitWritten(t, c, expect)
+
+	// 5 paced messages at 50/s take at least 4 intervals of 20ms
+	if elapsed := time.Nanoseconds() - start; elapsed < 80e6 {
+		t.Fatalf("Expected the replay to take at least 80ms, but it took %dns", elapsed)
+	}
+	c.Close()
+
+	// only the messages pending after an absence are replayed
+	transport := testTransport("polling")
+	c = newTestConn(t, sio)
+	for i := 0; i < 5; i++ {
+		c.Send(i)
+	}
+
+	c.online = false
+	c.lastDisconnected = time.Nanoseconds()
+	c.handle(transport, newTestResponseWriter(), newTestRequest("GET", "/socket.io/polling"))
+	if c.replay != 0 {
+		t.Fatalf("Did not expect an ordinary poll to be replayed, but got %d messages", c.replay)
+	}
+
+	c.online = false
+	c.lastDisconnected = time.Nanoseconds() - 2*config.HeartbeatInterval
+	c.handle(transport, newTestResponseWriter(), newTestRequest("GET", "/socket.io/polling"))
+	if c.replay != 5 {
+		t.Fatalf("Expected the 5 pending messages to be replayed after an absence, but got %d", c.replay)
+	}
+}
+
+func TestConnString(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+
+	if c.String() != string(c.sessionid) {
+		t.Fatalf("Expected %q but got %q", c.sessionid, c.String())
+	}
+
+	c.socket = NewWebsocketTransport(0, 0).newSocket(&DefaultConfig)
+	if c.String() != string(c.sessionid) {
+		t.Fatalf("Expected the string to stay %q, but got %q", c.sessionid, c.String())
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	disconnected := make(chan *Conn, 1)
+	sio.OnDisconnect(func(c *Conn) {
+		disconnected <- c
+	})
+	sio.OnMessage(func(c *Conn, msg Message) {
+		t.Fatalf("Did not expect a message after the disconnect, but got %q", msg.Data())
+	})
+
+	c := newTestConn(t, sio)
+	c.receive([]byte("0:0:," + frame("hi", 1, false)))
+
+	select {
+	case d := <-disconnected:
+		if d != c {
+			t.Fatal("Expected OnDisconnect to be invoked with the connection")
+		}
+	case <-time.After(config.ReconnectTimeout / 2):
+		t.Fatal("Expected the connection to be disconnected right away")
+	}
+	if sio.GetConn(c.sessionid) != nil || c.Connected() {
+		t.Fatal("Expected the connection to be removed")
+	}
+	if !c.socket.(*testSocket).closed {
+		t.Fatal("Expected the socket to be closed")
+	}
+}
+
+func TestUseOut(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+	other := newTestConn(t, sio)
+
+	c.UseOut(func(data interface{}) interface{} {
+		return fmt.Sprint(data, "-1")
+	})
+	c.UseOut(func(data interface{}) interface{} {
+		return fmt.Sprint(data, "-2")
+	})
+
+	sio.Broadcast("hello")
+	c.SendMeta("world", map[string]string{"ts": "1"})
+
+	go c.flusher()
+	go other.flusher()
+	waitWritten(t, c, frame("hello-1-2", 1, false)+"1:15:ts:1\n:world-1-2,")
+	waitWritten(t, other, frame("hello", 1, false))
+
+	c.Close()
+	other.Close()
+}
+
+func TestSendMeta(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+
+	for _, meta := range []map[string]string{{"a:b": "c"}, {"a": "b\nc"}, {"j": ""}, {"": "a"}} {
+		if err := c.SendMeta("hello", meta); err != ErrInvalidAnnotation {
+			t.Fatalf("Expected ErrInvalidAnnotation for %v, but got: %v", meta, err)
+		}
+	}
+	if c.queue.Len() != 0 {
+		t.Fatalf("Did not expect the invalid messages to be queued, but got %d", c.queue.Len())
+	}
+
+	if err := c.SendMeta("hello", map[string]string{"ts": "1"}); err != nil {
+		t.Fatal("SendMeta:", err)
+	}
+	go c.flusher()
+	waitWritten(t, c, "1:11:ts:1\n:hello,")
+}
+
+func TestOnClosing(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.HeartbeatInterval = 10e6
+	config.ReconnectTimeout = 10e6
+	sio := NewSocketIO(&config)
+	closing := make(chan *Conn, 2)
+	sio.OnClosing(func(c *Conn) interface{} {
+		closing <- c
+		if !c.Debug().Connected {
+			t.Error("Expected OnClosing to be invoked while the socket is live")
+		}
+		return "bye"
+	})
+	disconnected := make(chan *Conn, 2)
+	sio.OnDisconnect(func(c *Conn) {
+		disconnected <- c
+	})
+
+	// closed by the server
+	c := newTestConn(t, sio)
+	if err := c.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if cl := <-closing; cl != c {
+		t.Fatal("Expected OnClosing to be invoked on Close")
+	}
+	if socket := c.socket.(*testSocket); socket.Buffer.String() != frame("bye", 1, false) || !socket.closed {
+		t.Fatalf("Expected the farewell to be written before closing, but got %q", socket.Buffer.String())
+	}
+	<-disconnected
+
+	// the socket has been lost
+	c = newTestConn(t, sio)
+	c.online = false
+	c.lastDisconnected = time.Nanoseconds()
+	go c.keepalive()
+
+	if d := <-disconnected; d != c {
+		t.Fatal("Expected the lost connection to be disconnected")
+	}
+	if _, ok := <-closing; ok {
+		t.Fatal("Did not expect OnClosing to be invoked for a lost socket")
+	}
+}
+
+func TestCloseFromHandler(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	disconnected := make(chan *Conn, 1)
+	sio.OnDisconnect(func(c *Conn) {
+		disconnected <- c
+	})
+	sio.OnMessage(func(c *Conn, msg Message) {
+		if err := c.Close(); err != nil {
+			t.Fatal("Close:", err)
+		}
+	})
+
+	c := newTestConn(t, sio)
+	transport := sio.config.Transports[0]
+	data := "data=" + http.URLEscape(frame("bye", 1, false))
+	req := newTestRequest("POST", "/socket.io/"+transport.Resource()+"/"+string(c.sessionid))
+	req.Header["Content-Type"] = "application/x-www-form-urlencoded"
+	req.ContentLength = int64(len(data))
+	req.Body = &testBody{Reader: strings.NewReader(data)}
+
+	go sio.handle(transport, newTestResponseWriter(), req)
+
+	select {
+	case d := <-disconnected:
+		if d != c {
+			t.Fatal("Expected OnDisconnect to be invoked with the connection")
+		}
+	case <-time.After(5e9):
+		t.Fatal("Closing the connection from its OnMessage callback deadlocked")
+	}
+	if sio.GetConn(c.sessionid) != nil {
+		t.Fatal("Expected the connection to be removed")
+	}
+}
+
+func TestMalformedInput(t *testing.T) {
+	for _, in := range []string{"1:x:a,", "7:1:a,", frame("abc", 3, false)} {
+		config := DefaultConfig
+		config.Logger = NOPLogger
+		sio := NewSocketIO(&config)
+		var errors []interface{}
+		sio.OnError(func(c *Conn, v interface{}, stack []byte) {
+			errors = append(errors, v)
+		})
+		sio.OnMessage(func(c *Conn, msg Message) {
+			t.Fatalf("Did not expect the message of %q to be dispatched", in)
+		})
+
+		c := newTestConn(t, sio)
+		c.receive([]byte(in))
+		if len(errors) != 1 {
+			t.Fatalf("Expected %q to be reported to OnError, but got %v", in, errors)
+		}
+		if c.Connected() {
+			t.Fatalf("Expected the connection to be closed after %q", in)
+		}
+	}
+}
+
+func TestPanickingHandler(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	var recovered interface{}
+	var stack []byte
+	sio.OnError(func(c *Conn, v interface{}, s []byte) {
+		recovered, stack = v, s
+	})
+	var received []string
+	sio.OnMessage(func(c *Conn, msg Message) {
+		if msg.Data() == "boom" {
+			panic("boom")
+		}
+		received = append(received, msg.Data())
+	})
+
+	c := newTestConn(t, sio)
+	c.receive([]byte(frame("boom", 1, false) + frame("ok", 1, false)))
+
+	if recovered != "boom" || len(stack) == 0 {
+		t.Fatalf("Expected OnError to be invoked with the panic and a stack trace, but got %v", recovered)
+	}
+	if len(received) != 1 || received[0] != "ok" {
+		t.Fatalf("Expected the following message to be dispatched, but got %v", received)
+	}
+	if sio.GetConn(c.sessionid) != c || !c.Connected() {
+		t.Fatal("Expected the connection to survive the panic")
+	}
+}
+
+func TestOnRaw(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	var inbound []byte
+	sio.OnRawInbound(func(c *Conn, raw []byte) {
+		inbound = raw
+	})
+	outbound := make(chan []byte, 1)
+	sio.OnRawOutbound(func(c *Conn, raw []byte) {
+		raw[0] = 'x'
+		outbound <- raw
+	})
+
+	c := newTestConn(t, sio)
+	payload := []byte(frame("hi", 1, false))
+	c.receive(payload)
+	if string(inbound) != frame("hi", 1, false) {
+		t.Fatalf("Expected the raw inbound bytes %q, but got %q", payload, inbound)
+	}
+
+	c.Send("hello")
+	go c.flusher()
+	waitWritten(t, c, frame("hello", 1, false))
+	if raw := <-outbound; string(raw[1:]) != frame("hello", 1, false)[1:] {
+		t.Fatalf("Expected the raw outbound bytes, but got %q", raw)
+	}
+	c.Close()
+}
+
+func TestOnRawInboundInject(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	msgs, err := config.Codec.NewDecoder(bytes.NewBufferString(frame("tapped", 1, false))).Decode()
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	sio.OnRawInbound(func(c *Conn, raw []byte) {
+		c.Inject(msgs[0])
+	})
+	var received []string
+	sio.OnMessage(func(c *Conn, msg Message) {
+		received = append(received, msg.Data())
+	})
+
+	c := newTestConn(t, sio)
+	done := make(chan bool)
+	go func() {
+		c.receive([]byte(frame("hi", 1, false)))
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5e9):
+		t.Fatal("Expected a tap injecting a message not to deadlock the connection")
+	}
+	if len(received) != 2 || received[0] != "tapped" || received[1] != "hi" {
+		t.Fatalf("Expected [tapped hi] but got %v", received)
+	}
+}
+
+func TestSetSendRate(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+	c.SetSendRate(1000)
+
+	data := strings.Repeat("x", 512)
+	expect := ""
+	for i := 0; i < 3; i++ {
+		c.Send(data)
+		expect += frame(data, 1, false)
+	}
+
+	// the first frame fits in the bucket, the rest must wait for ~560 bytes worth
+	start := time.Nanoseconds()
+	go c.flusher()
+	waitWritten(t, c, expect)
+	if elapsed := time.Nanoseconds() - start; elapsed < 400e6 {
+		t.Fatalf("Expected the writes to take at least 400ms, but they took %dns", elapsed)
+	}
+	c.Close()
+}
+
+func TestSetTimeouts(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.HeartbeatInterval = 10e9
+	sio := NewSocketIO(&config)
+	disconnected := make(chan *Conn, 1)
+	sio.OnDisconnect(func(c *Conn) {
+		disconnected <- c
+	})
+
+	c := newTestConn(t, sio)
+	c.SetTimeouts(20e6, 0)
+	if heartbeatInterval, reconnectTimeout := c.Timeouts(); heartbeatInterval != 20e6 || reconnectTimeout != config.ReconnectTimeout {
+		t.Fatalf("Expected the timeouts 20e6 and %d, but got %d and %d", config.ReconnectTimeout, heartbeatInterval, reconnectTimeout)
+	}
+
+	// the heartbeats are not answered, so the second tick disconnects
+	go c.keepalive()
+	select {
+	case <-disconnected:
+	case <-time.After(config.HeartbeatInterval / 2):
+		t.Fatal("Expected the connection to use its own heartbeat interval")
+	}
+}
+
+func TestOnOverflow(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.QueueLength = 2
+	sio := NewSocketIO(&config)
+	var overflowed *Conn
+	var dropped int
+	sio.OnOverflow(func(c *Conn, n int) {
+		overflowed = c
+		dropped += n
+	})
+
+	c := newTestConn(t, sio)
+	for i := 0; i < 4; i++ {
+		c.Send(i)
+	}
+
+	if overflowed != c || dropped != 2 {
+		t.Fatalf("Expected 2 dropped messages, but got %d", dropped)
+	}
+
+	// the heartbeat overflows the queue
+	config.HeartbeatInterval = 10e6
+	sio = NewSocketIO(&config)
+	overflows, disconnected := make(chan *Conn, 1), make(chan *Conn, 1)
+	sio.OnOverflow(func(c *Conn, n int) {
+		overflows <- c
+	})
+	sio.OnDisconnect(func(c *Conn) {
+		disconnected <- c
+	})
+
+	c = newTestConn(t, sio)
+	c.Send("a")
+	c.Send("b")
+	go c.keepalive()
+
+	if o := <-overflows; o != c {
+		t.Fatal("Expected the heartbeat to overflow the queue")
+	}
+	if d := <-disconnected; d != c {
+		t.Fatal("Expected the overflowed connection to be disconnected")
+	}
+}
+
+func TestSlowHandlerHeartbeats(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.HeartbeatInterval = 50e6
+	sio := NewSocketIO(&config)
+	proceed := make(chan bool)
+	sio.OnMessage(func(c *Conn, msg Message) {
+		c.Send("reply")
+		<-proceed
+	})
+
+	c := newTestConn(t, sio)
+	socket := c.socket.(*testSocket)
+	go c.flusher()
+	go c.keepalive()
+	go c.receive([]byte(frame("hello", 1, false)))
+
+	// the heartbeats get through and are answered while the handler runs
+	for i := 1; i <= 3; i++ {
+		hb := frame(strconv.Itoa(i), 2, false)
+		start := time.Nanoseconds()
+		for {
+			c.mutex.Lock()
+			written := socket.Buffer.String()
+			c.mutex.Unlock()
+
+			if strings.Contains(written, frame("reply", 1, false)) {
+				t.Fatal("Did not expect the reply to be sent before the handler returns")
+			}
+			if strings.Contains(written, hb) {
+				break
+			}
+			if time.Nanoseconds()-start > 5e9 {
+				t.Fatalf("Expected the heartbeat %d to be sent, but got %q", i, written)
+			}
+			time.Sleep(1e6)
+		}
+		c.receive([]byte(hb))
+	}
+
+	if !c.Connected() {
+		t.Fatal("Expected the connection to stay connected during a slow handler")
+	}
+	proceed <- true
+	c.Close()
+}
+
+func TestConnLog(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+
+	buf := new(bytes.Buffer)
+	sio.SetLogger(log.New(buf, "", 0))
+	c.Log("hello")
+	c.SetLogContext("req=42")
+	c.Logf("%d%%", 100)
+
+	expect := fmt.Sprintf("sio/conn[%s]: hello\nsio/conn[%s req=42]: 100%%\n", c, c)
+	if buf.String() != expect {
+		t.Fatalf("Expected %q but got %q", expect, buf.String())
+	}
+}
+
+func TestOnUpgrade(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	type upgrade struct {
+		c        *Conn
+		from, to Transport
+	}
+	upgraded := make(chan upgrade, 2)
+	sio.OnUpgrade(func(c *Conn, from, to Transport) {
+		upgraded <- upgrade{c, from, to}
+	})
+
+	polling, websocket := testTransport("polling"), testTransport("websocket")
+	c := newTestConn(t, sio)
+	c.socket.(*testSocket).t = polling
+
+	c.handle(polling, newTestResponseWriter(), newTestRequest("GET", "/socket.io/polling"))
+	c.handle(websocket, newTestResponseWriter(), newTestRequest("GET", "/socket.io/websocket"))
+
+	select {
+	case u := <-upgraded:
+		if u.c != c || u.from != polling || u.to != websocket {
+			t.Fatalf("Expected an upgrade from %s to %s, but got %s to %s", polling, websocket, u.from, u.to)
+		}
+	case <-time.After(1e9):
+		t.Fatal("Expected OnUpgrade to be invoked")
+	}
+
+	select {
+	case u := <-upgraded:
+		t.Fatalf("Expected a single upgrade, but got another from %s to %s", u.from, u.to)
+	case <-time.After(50e6):
+	}
+}
+
+func TestMaxFramesPerPoll(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.MaxFramesPerPoll = 2
+	sio := NewSocketIO(&config)
+	written := make(chan string, 3)
+	sio.OnRawOutbound(func(c *Conn, raw []byte) {
+		written <- string(raw)
+	})
+
+	c := newTestConn(t, sio)
+	c.socket.(*testSocket).t = config.Transports[0]
+	for _, s := range []string{"a", "b", "c"} {
+		c.Send(s)
+	}
+	go c.flusher()
+	defer c.Close()
+
+	expect := []string{
+		frame("a", 1, false) + frame("b", 1, false),
+		frame("c", 1, false),
+	}
+	for i, e := range expect {
+		select {
+		case w := <-written:
+			if w != e {
+				t.Fatalf("Expected the response %d to be %q, but got %q", i+1, e, w)
+			}
+		case <-time.After(1e9):
+			t.Fatalf("Expected %d responses", len(expect))
+		}
+	}
+}
+
+func TestDuplicateSessionPolicy(t *testing.T) {
+	for _, policy := range []int{ReplaceOld, RejectNew} {
+		config := DefaultConfig
+		config.Logger = NOPLogger
+		config.DuplicateSessionPolicy = policy
+		sio := NewSocketIO(&config)
+		transport := testTransport("test")
+
+		c := newTestConn(t, sio)
+		first := c.socket.(*testSocket)
+		err := c.handle(transport, newTestResponseWriter(), newTestRequest("GET", "/socket.io/test/"+c.String()))
+
+		switch policy {
+		case ReplaceOld:
+			if err != nil || c.socket == first || !first.closed {
+				t.Fatalf("ReplaceOld: expected the first socket to be replaced and closed, but got: %v", err)
+			}
+
+		case RejectNew:
+			if err != ErrConnected || c.socket != first || first.closed {
+				t.Fatalf("RejectNew: expected ErrConnected and the first socket to be kept, but got: %v", err)
+			}
+		}
+	}
+
+	// two sockets binding to an offline session at once
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.DuplicateSessionPolicy = RejectNew
+	sio := NewSocketIO(&config)
+	transport := testTransport("test")
+
+	c := newTestConn(t, sio)
+	c.online = false
+	errs := make(chan os.Error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- c.handle(transport, newTestResponseWriter(), newTestRequest("GET", "/socket.io/test/"+c.String()))
+		}()
+	}
+
+	var won, rejected int
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; err {
+		case nil:
+			won++
+		case ErrConnected:
+			rejected++
+		default:
+			t.Fatal("handle:", err)
+		}
+	}
+	if won != 1 || rejected != 1 {
+		t.Fatalf("Expected exactly one of the concurrent binds to win, but %d won and %d were rejected", won, rejected)
+	}
+}
+
+func TestOnDeadLetter(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	dead := make(chan interface{}, 3)
+	c := newTestConn(t, sio)
+	sio.OnDeadLetter(func(id SessionID, data interface{}) {
+		if id != c.sessionid {
+			t.Errorf("Expected the session id %s, but got %s", c.sessionid, id)
+		}
+		dead <- data
+	})
+
+	c.Send("a")
+	c.SendMeta("b", map[string]string{"ts": "1"})
+	c.Send(heartbeat(1))
+
+	c.mutex.Lock()
+	c.disconnect()
+	c.mutex.Unlock()
+	c.flusher()
+
+	close(dead)
+	var letters []interface{}
+	for data := range dead {
+		letters = append(letters, data)
+	}
+	if len(letters) != 2 || letters[0] != "a" || letters[1] != "b" {
+		t.Fatalf("Expected the dead letters [a b], but got %v", letters)
+	}
+}
+
+func TestOnSendError(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+	failed := make(chan interface{}, 3)
+	c.OnSendError(func(data interface{}, err os.Error) {
+		if err != ErrDestroyed {
+			t.Errorf("Expected ErrDestroyed, but got: %v", err)
+		}
+		failed <- data
+	})
+
+	c.Send("a")
+	c.SendMeta("b", map[string]string{"ts": "1"})
+	c.Send(heartbeat(1))
+
+	c.mutex.Lock()
+	c.disconnect()
+	c.mutex.Unlock()
+	c.flusher()
+
+	close(failed)
+	var datas []interface{}
+	for data := range failed {
+		datas = append(datas, data)
+	}
+	if len(datas) != 2 || datas[0] != "a" || datas[1] != "b" {
+		t.Fatalf("Expected the failed messages [a b], but got %v", datas)
+	}
+}
+
+func TestSendTTL(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+	failed := make(chan interface{}, 2)
+	c.OnSendError(func(data interface{}, err os.Error) {
+		if err != ErrExpired {
+			t.Errorf("Expected ErrExpired, but got: %v", err)
+		}
+		failed <- data
+	})
+
+	c.SendTTL("stale", 1e6)
+	c.SendTTL("fresh", 10e9)
+	time.Sleep(10e6)
+
+	go c.flusher()
+	waitWritten(t, c, frame("fresh", 1, false))
+	c.Close()
+
+	if data := <-failed; data != "stale" {
+		t.Fatalf("Expected the stale message to expire, but got %v", data)
+	}
+}
+
+func TestInject(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	var received []string
+	sio.OnMessage(func(c *Conn, msg Message) {
+		received = append(received, msg.Data())
+	})
+
+	buf := bytes.NewBufferString(frame("relayed", 1, false))
+	msgs, err := config.Codec.NewDecoder(buf).Decode()
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Decode: expected a single message, but got %d: %v", len(msgs), err)
+	}
+
+	c := newTestConn(t, sio)
+	c.Inject(msgs[0])
+	if len(received) != 1 || received[0] != "relayed" {
+		t.Fatalf("Expected the injected message to be dispatched, but got %v", received)
+	}
+	if info := c.Debug(); info.PacketsReceived != 0 {
+		t.Fatalf("Did not expect the injected message to be counted, but got %d", info.PacketsReceived)
+	}
+}
+
+func TestInjectBridge(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	decode := func(data string) Message {
+		msgs, err := config.Codec.NewDecoder(bytes.NewBufferString(frame(data, 1, false))).Decode()
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Decode: expected a single message, but got %d: %v", len(msgs), err)
+		}
+		return msgs[0]
+	}
+
+	a, b := newTestConn(t, sio), newTestConn(t, sio)
+	var handled []string
+	sio.OnMessage(func(c *Conn, msg Message) {
+		switch {
+		case c == a && msg.Data() == "ping":
+			handled = append(handled, "a:ping")
+			b.Inject(msg)
+		case c == b && msg.Data() == "ping":
+			handled = append(handled, "b:ping")
+			a.Inject(decode("pong"))
+		default:
+			handled = append(handled, "a:"+msg.Data())
+		}
+	})
+
+	done := make(chan bool)
+	go func() {
+		a.receive([]byte(frame("ping", 1, false)))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(1e9):
+		t.Fatal("Expected the bridged connections to inject into each other without a deadlock")
+	}
+
+	if strings.Join(handled, " ") != "a:ping b:ping a:pong" {
+		t.Fatalf("Expected the messages to be handled in order, but got %v", handled)
+	}
+}
+
+func TestPendingMessages(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	var pending []interface{}
+	sio.OnDisconnect(func(c *Conn) {
+		pending = c.PendingMessages()
+	})
+
+	c := newTestConn(t, sio)
+	c.Send("a")
+	c.SendMeta("b", map[string]string{"ts": "1"})
+	c.Send(heartbeat(1))
+	if p := c.PendingMessages(); p != nil {
+		t.Fatalf("Did not expect pending messages before the disconnect, but got %v", p)
+	}
+
+	c.receive([]byte("0:0:,"))
+	if len(pending) != 2 || pending[0] != "a" || pending[1] != "b" {
+		t.Fatalf("Expected the pending messages [a b], but got %v", pending)
+	}
+}
+
+func TestMaxConcurrentHandlers(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.MaxConcurrentHandlers = 2
+	sio := NewSocketIO(&config)
+	started, finish := make(chan string, 3), make(chan bool)
+	sio.OnMessage(func(c *Conn, msg Message) {
+		started <- msg.Data()
+		<-finish
+	})
+
+	c := newTestConn(t, sio)
+	received := make(chan bool)
+	go func() {
+		c.receive([]byte(frame("1", 1, false) + frame("2", 1, false) + frame("3", 1, false)))
+		received <- true
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(1e9):
+			t.Fatal("Expected 2 handlers to run concurrently")
+		}
+	}
+	select {
+	case data := <-started:
+		t.Fatalf("Expected the third message to wait for a handler, but %q started", data)
+	case <-received:
+		t.Fatal("Expected the receive to block while the handlers are busy")
+	case <-time.After(50e6):
+	}
+
+	finish <- true
+	select {
+	case <-started:
+	case <-time.After(1e9):
+		t.Fatal("Expected the third message to be handled once a handler returned")
+	}
+	<-received
+	finish <- true
+	finish <- true
+}
+
+func TestCurrentRequest(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	var trace string
+	sio.OnMessage(func(c *Conn, msg Message) {
+		if req := c.CurrentRequest(); req != nil {
+			trace = req.Header["X-Trace-Id"]
+		}
+	})
+
+	c := newTestConn(t, sio)
+	req := newTestRequest("POST", "/socket.io/xhr-polling/"+c.String()+"/send")
+	req.Header["X-Trace-Id"] = "abc"
+	req.Form = map[string][]string{"data": {frame("hi", 1, false)}}
+	if err := c.handle(config.Transports[0], newTestResponseWriter(), req); err != nil {
+		t.Fatal("handle:", err)
+	}
+	if trace != "abc" {
+		t.Fatalf("Expected the handler to see the request, but got the trace id %q", trace)
+	}
+	if c.CurrentRequest() != nil {
+		t.Fatal("Did not expect the request to outlive the handler")
+	}
+
+	trace = ""
+	c.receive([]byte(frame("hi", 1, false)))
+	if trace != "" {
+		t.Fatal("Did not expect a request for a message received through the socket")
+	}
+}
@@ -0,0 +1,78 @@
+package socketio
+
+import (
+	"time"
+)
+
+const (
+	// AnnotationID carries the client-supplied id of an inbound message, see
+	// Config.DedupeWindow.
+	AnnotationID = "id"
+
+	// AnnotationAck carries the id of a duplicate message in the empty message
+	// acknowledging it, see Config.DedupeAck.
+	AnnotationAck = "ack"
+)
+
+// The number of message ids a connection remembers at most.
+const dedupeMaxIDs = 1024
+
+// SeenID is a message id along with the time it was received.
+type seenID struct {
+	id string
+	at int64
+}
+
+// DedupeWindow remembers the ids of the recently received messages.
+type dedupeWindow struct {
+	ids   map[string]int64 // The time each id was received.
+	order []seenID         // The ids in the order they were received.
+}
+
+// Seen reports whether id has been received within window ns of now and
+// remembers it otherwise.
+func (w *dedupeWindow) seen(id string, now, window int64) bool {
+	for len(w.order) > 0 && (now-w.order[0].at > window || len(w.order) >= dedupeMaxIDs) {
+		if w.ids[w.order[0].id] == w.order[0].at {
+			w.ids[w.order[0].id] = 0, false
+		}
+		w.order = w.order[1:]
+	}
+
+	if _, ok := w.ids[id]; ok {
+		return true
+	}
+
+	w.ids[id] = now
+	w.order = append(w.order, seenID{id, now})
+	return false
+}
+
+// Duplicate reports whether msg carries an id that has been received within
+// config.DedupeWindow and acknowledges such message if config.DedupeAck is set.
+// The acks bypass the send queue limits, but at most dedupeMaxIDs of them may be
+// pending. It must be called with c.recvMutex held.
+func (c *Conn) duplicate(msg Message) bool {
+	window := c.server().config.DedupeWindow
+	if window <= 0 {
+		return false
+	}
+
+	id, ok := msg.Annotation(AnnotationID)
+	if !ok {
+		return false
+	}
+
+	if c.seen == nil {
+		c.seen = &dedupeWindow{ids: make(map[string]int64)}
+	}
+	if !c.seen.seen(id, time.Nanoseconds(), window) {
+		return false
+	}
+
+	c.Log("dropped a duplicate message:", id)
+	if c.server().config.DedupeAck {
+		c.queue.pushUrgent(&QueueItem{Data: ack(id)}, dedupeMaxIDs)
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package socketio
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDedupeWindow(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.DedupeWindow = 10e9
+	config.DedupeAck = true
+	config.QueueLength = 1
+	sio := NewSocketIO(&config)
+	sio.OnOverflow(func(c *Conn, n int) {
+		t.Fatal("Did not expect the ack to overflow the queue")
+	})
+	var received []string
+	sio.OnMessage(func(c *Conn, msg Message) {
+		received = append(received, msg.Data())
+	})
+	c := newTestConn(t, sio)
+	// the ack is not subject to QueueLength
+	c.Send("full")
+
+	enc := config.Codec.NewEncoder()
+	for _, id := range []string{"1", "2", "1"} {
+		buf := new(bytes.Buffer)
+		if err := enc.Encode(buf, annotated{"hello " + id, map[string]string{AnnotationID: id}}); err != nil {
+			t.Fatal("Encode:", err)
+		}
+		c.receive(buf.Bytes())
+	}
+
+	if len(received) != 2 || received[0] != "hello 1" || received[1] != "hello 2" {
+		t.Fatalf("Expected the duplicate to be dropped, but got %v", received)
+	}
+
+	go c.flusher()
+	waitWritten(t, c, "1:7:ack:1\n:,"+frame("full", 1, false))
+}
+
+func TestDedupeWindowNoAck(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.DedupeWindow = 10e9
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+
+	buf := new(bytes.Buffer)
+	if err := config.Codec.NewEncoder().Encode(buf, annotated{"hello", map[string]string{AnnotationID: "1"}}); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	c.receive(buf.Bytes())
+	c.receive(buf.Bytes())
+
+	if n := c.queue.Len(); n != 0 {
+		t.Fatalf("Did not expect the duplicate to be acknowledged by default, but got %d queued messages", n)
+	}
+}
+
+func TestDedupeWindowExpiry(t *testing.T) {
+	w := &dedupeWindow{ids: make(map[string]int64)}
+
+	if w.seen("a", 0, 100) {
+		t.Fatal("Did not expect a new id to be seen")
+	}
+	if !w.seen("a", 50, 100) {
+		t.Fatal("Expected the id to be seen within the window")
+	}
+	if w.seen("a", 200, 100) {
+		t.Fatal("Did not expect the id to be seen after the window")
+	}
+}
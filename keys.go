@@ -0,0 +1,91 @@
+package socketio
+
+// Register assigns the user key key to the established connection c, e.g. the id of
+// the authenticated user, so that the connection can be reached with SendToKey. Many
+// connections can share a key, e.g. one per device of the user, but a connection
+// has at most one key: registering it again replaces its previous key. The key is
+// dropped when the connection is disconnected and registering a connection that is
+// not established has no effect.
+func (sio *SocketIO) Register(key string, c *Conn) {
+	sio.sessionsLock.Lock()
+	defer sio.sessionsLock.Unlock()
+
+	if sio.sessions[c.sessionid] != c {
+		return
+	}
+
+	sio.unregisterConn(c)
+	sio.registerConn(c, key)
+}
+
+// SendToKey schedules data to be sent to each connection registered with key and
+// returns the number of those connections.
+func (sio *SocketIO) SendToKey(key string, data interface{}) (n int) {
+	sio.sessionsLock.RLock()
+	conns := sio.keyConns(key, nil)
+	sio.sessionsLock.RUnlock()
+
+	for _, c := range conns {
+		c.Send(data)
+	}
+	return len(conns)
+}
+
+// BroadcastToOtherDevices schedules data to be sent to each connection registered
+// with the same user key as c, except c itself, e.g. to sync the state changed on one
+// device of the user to the other ones. It returns the number of those connections.
+// If c has no user key, nothing is sent.
+func (c *Conn) BroadcastToOtherDevices(data interface{}) int {
+	sio := c.lockSessions(false)
+	var conns []*Conn
+	if c.key != "" {
+		conns = sio.keyConns(c.key, c)
+	}
+	sio.sessionsLock.RUnlock()
+
+	for _, v := range conns {
+		v.Send(data)
+	}
+	return len(conns)
+}
+
+// KeyConns returns a snapshot of the connections registered with key, except the
+// connection except. It must be called with sio.sessionsLock held.
+func (sio *SocketIO) keyConns(key string, except *Conn) []*Conn {
+	conns := make([]*Conn, 0, len(sio.keys[key]))
+	for _, c := range sio.keys[key] {
+		if c != except {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// RegisterConn adds c to the key index under key. It must be called with
+// sio.sessionsLock held.
+func (sio *SocketIO) registerConn(c *Conn, key string) {
+	c.key = key
+
+	conns, ok := sio.keys[key]
+	if !ok {
+		conns = make(map[SessionID]*Conn)
+		sio.keys[key] = conns
+	}
+	conns[c.sessionid] = c
+}
+
+// UnregisterConn removes c from the key index. It must be called with
+// sio.sessionsLock held.
+func (sio *SocketIO) unregisterConn(c *Conn) {
+	if c.key == "" {
+		return
+	}
+
+	if conns, ok := sio.keys[c.key]; ok {
+		conns[c.sessionid] = nil, false
+		if len(conns) == 0 {
+			sio.keys[c.key] = nil, false
+		}
+	}
+	c.key = ""
+}
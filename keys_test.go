@@ -0,0 +1,54 @@
+package socketio
+
+import (
+	"testing"
+)
+
+func TestSendToKey(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	phone, laptop, other := newTestConn(t, sio), newTestConn(t, sio), newTestConn(t, sio)
+	sio.Register("alice", phone)
+	sio.Register("alice", laptop)
+	sio.Register("bob", other)
+	sio.Register("alice", other)
+	sio.Register("bob", other)
+
+	if n := sio.SendToKey("alice", "hello"); n != 2 {
+		t.Fatalf("Expected to send to 2 connections, but sent to %d", n)
+	}
+	if phone.queue.Len() != 1 || laptop.queue.Len() != 1 || other.queue.Len() != 0 {
+		t.Fatal("Expected only the connections of alice to get the message")
+	}
+
+	sio.onDisconnect(phone)
+	if n := sio.SendToKey("alice", "hello"); n != 1 {
+		t.Fatalf("Expected to send to 1 connection after a disconnect, but sent to %d", n)
+	}
+	if n := sio.SendToKey("carol", "hello"); n != 0 {
+		t.Fatalf("Expected to send to no connections, but sent to %d", n)
+	}
+}
+
+func TestBroadcastToOtherDevices(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	phone, laptop, tablet, other := newTestConn(t, sio), newTestConn(t, sio), newTestConn(t, sio), newTestConn(t, sio)
+	for _, c := range []*Conn{phone, laptop, tablet} {
+		sio.Register("alice", c)
+	}
+
+	if n := phone.BroadcastToOtherDevices("read"); n != 2 {
+		t.Fatalf("Expected to send to 2 connections, but sent to %d", n)
+	}
+	if phone.queue.Len() != 0 || laptop.queue.Len() != 1 || tablet.queue.Len() != 1 {
+		t.Fatal("Expected only the other devices of alice to get the message")
+	}
+	if n := other.BroadcastToOtherDevices("read"); n != 0 {
+		t.Fatalf("Expected a connection without a key to send to nobody, but sent to %d", n)
+	}
+}
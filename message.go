@@ -31,6 +31,18 @@ type disconnect int
 // session id.
 type handshake string
 
+// Ack is the empty message acknowledging a duplicate message. It is made of the id
+// of the duplicate, see Config.DedupeWindow.
+type ack string
+
+// Annotated wraps a message payload with annotations, i.e. metadata that the
+// codec sends along with the payload. The codecs that don't support annotations
+// encode just the payload.
+type annotated struct {
+	data        interface{}
+	annotations map[string]string
+}
+
 // Message wraps heartbeat, messageType and data methods.
 //
 // Heartbeat returns the heartbeat value encapsulated in the message and an true
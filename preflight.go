@@ -0,0 +1,50 @@
+package socketio
+
+import (
+	"strings"
+	"time"
+)
+
+// The status code of the preflight requests refused by config.MaxPreflightRate.
+const statusTooManyRequests = 429
+
+// The number of clients tracked before the idle ones are forgotten.
+const preflightSweepSize = 1024
+
+// AllowPreflight reports whether the OPTIONS request from the remote address addr
+// is within config.MaxPreflightRate. Each client may burst up to a second's worth of
+// requests and is then topped up at the given rate.
+func (sio *SocketIO) allowPreflight(addr string) bool {
+	rate := float64(sio.config.MaxPreflightRate)
+	if rate <= 0 {
+		return true
+	}
+
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		addr = addr[:i]
+	}
+	now := time.Nanoseconds()
+
+	sio.preflights.Lock()
+	defer sio.preflights.Unlock()
+
+	if sio.preflights.buckets == nil {
+		sio.preflights.buckets = make(map[string]*tokenBucket)
+	}
+
+	b, ok := sio.preflights.buckets[addr]
+	if !ok {
+		if len(sio.preflights.buckets) >= preflightSweepSize {
+			// the buckets idle for a second are full again, so they can be dropped
+			for a, v := range sio.preflights.buckets {
+				if now-v.at > 1e9 {
+					sio.preflights.buckets[a] = nil, false
+				}
+			}
+		}
+		b = newTokenBucket(rate, now)
+		sio.preflights.buckets[addr] = b
+	}
+
+	return b.take(rate, now)
+}
@@ -0,0 +1,28 @@
+package socketio
+
+import (
+	"http"
+	"testing"
+)
+
+func TestMaxPreflightRate(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.MaxPreflightRate = 2
+	sio := NewSocketIO(&config)
+	transport := config.Transports[0]
+
+	expect := []int{http.StatusOK, http.StatusOK, statusTooManyRequests}
+	for i, status := range expect {
+		w := newTestResponseWriter()
+		sio.handle(transport, w, newTestRequest("OPTIONS", "/socket.io/"+transport.Resource()))
+		if w.status != status {
+			t.Fatalf("Expected the preflight %d to get %d, but got %d", i+1, status, w.status)
+		}
+	}
+
+	// the other clients have buckets of their own
+	if !sio.allowPreflight("10.0.0.1:1234") {
+		t.Fatal("Expected the preflight of another client to be allowed")
+	}
+}
@@ -0,0 +1,38 @@
+package socketio
+
+// Presence is a live view of all the established connections of a server, see
+// SocketIO.All. It behaves like a group every connection joins when it is
+// established and leaves when it is disconnected, without any bookkeeping.
+type Presence struct {
+	sio *SocketIO
+}
+
+// All returns the Presence of the server, e.g. for an online users feature.
+func (sio *SocketIO) All() Presence {
+	return Presence{sio}
+}
+
+// Count returns the number of established connections.
+func (p Presence) Count() int {
+	p.sio.sessionsLock.RLock()
+	defer p.sio.sessionsLock.RUnlock()
+
+	return len(p.sio.sessions)
+}
+
+// IDs returns the session ids of the established connections. If
+// config.StableBroadcastOrder is set, the ids are sorted.
+func (p Presence) IDs() []SessionID {
+	conns := p.sio.conns()
+	ids := make([]SessionID, len(conns))
+	for i, c := range conns {
+		ids[i] = c.sessionid
+	}
+	return ids
+}
+
+// Broadcast schedules data to be sent to each connection, just like
+// SocketIO.Broadcast.
+func (p Presence) Broadcast(data interface{}) {
+	p.sio.Broadcast(data)
+}
@@ -0,0 +1,29 @@
+package socketio
+
+import (
+	"testing"
+)
+
+func TestPresence(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.StableBroadcastOrder = true
+	sio := NewSocketIO(&config)
+	all := sio.All()
+
+	a, b := newTestConn(t, sio), newTestConn(t, sio)
+	if n := all.Count(); n != 2 {
+		t.Fatalf("Expected 2 connections, but got %d", n)
+	}
+
+	sio.onDisconnect(a)
+	ids := all.IDs()
+	if all.Count() != 1 || len(ids) != 1 || ids[0] != b.sessionid {
+		t.Fatalf("Expected only %s to be present, but got %v", b, ids)
+	}
+
+	all.Broadcast("hello")
+	if b.queue.Len() != 1 {
+		t.Fatal("Expected the broadcast to reach the present connection")
+	}
+}
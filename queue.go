@@ -0,0 +1,364 @@
+package socketio
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// QueueItem is a single pending outbound message.
+type QueueItem struct {
+	Data     interface{} // The data given to Send.
+	Key      string      // The coalescing key given to Conn.SendKeyed or "".
+	Priority int         // The priority given to Conn.SendPriority or 0.
+	Expires  int64       // The time after which the item is dropped, see Conn.SendTTL, or 0.
+}
+
+// IsControl reports whether item carries a control message, i.e. a heartbeat, a
+// disconnect or an ack. The control messages keep the connection alive, so they
+// are never held back, see sendQueue.hold.
+func isControl(item *QueueItem) bool {
+	switch item.Data.(type) {
+	case heartbeat, disconnect, ack:
+		return true
+	}
+	return false
+}
+
+// WriteQueue is the interface that wraps the storage of the outbound messages of
+// a connection, see Config.NewQueue. The queues don't need to be safe for
+// concurrent use, the connection takes care of the locking.
+//
+// Enqueue adds item to the queue. It returns false if there is no room for it.
+// Dequeue removes and returns the next item to be written or false if the queue
+// is empty.
+// Len returns the number of items in the queue.
+type WriteQueue interface {
+	Enqueue(item *QueueItem) bool
+	Dequeue() (*QueueItem, bool)
+	Len() int
+}
+
+// FIFOQueue is the default WriteQueue.
+type fifoQueue struct {
+	items []*QueueItem
+	limit int
+}
+
+// NewFIFOQueue creates the default WriteQueue that holds at most limit items. The
+// items are dequeued in the order of descending priority and in FIFO order among the
+// items of equal priority. If an item carries a key and the tail-most item in the
+// queue has the same key, the tail is replaced instead, which is what makes the
+// keyed sends possible.
+func NewFIFOQueue(limit int) WriteQueue {
+	return &fifoQueue{limit: limit}
+}
+
+func (q *fifoQueue) Enqueue(item *QueueItem) bool {
+	if l := len(q.items); item.Key != "" && l > 0 && q.items[l-1].Key == item.Key {
+		q.items[l-1] = item
+		return true
+	}
+
+	if len(q.items) >= q.limit {
+		return false
+	}
+
+	i := len(q.items)
+	for i > 0 && q.items[i-1].Priority < item.Priority {
+		i--
+	}
+	q.items = append(q.items, nil)
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = item
+	return true
+}
+
+func (q *fifoQueue) Dequeue() (item *QueueItem, ok bool) {
+	if len(q.items) == 0 {
+		return nil, false
+	}
+
+	item, q.items = q.items[0], q.items[1:]
+	return item, true
+}
+
+func (q *fifoQueue) Len() int {
+	return len(q.items)
+}
+
+// SendQueue synchronizes the access to the WriteQueue of a connection. On top of
+// the WriteQueue it makes the pops blocking, holds back the items when asked to
+// and keeps track of the popped items that have not been written yet.
+type sendQueue struct {
+	mutex    sync.Mutex
+	queue    WriteQueue
+	busy     int          // Number of popped items that are not done yet.
+	holds    int          // Number of the holds not released yet.
+	lifted   bool         // Are the holds lifted until they are all released.
+	controls int          // Number of the queued control items, see isControl.
+	urgent   []*QueueItem // The items bypassing the WriteQueue, see pushUrgent.
+	closed   bool
+	wakeup   chan byte // Signaled whenever a new item becomes available.
+	popped   int64     // The time of the last pop.
+	rejected int64     // The time of the last push refused by a full queue.
+}
+
+// NewSendQueue creates a new queue storing the items in wq.
+func newSendQueue(wq WriteQueue) *sendQueue {
+	return &sendQueue{
+		queue:  wq,
+		wakeup: make(chan byte, 1),
+		popped: time.Nanoseconds(),
+	}
+}
+
+// Push enqueues item. It returns ErrDestroyed if the queue has been closed and
+// ErrQueueFull if there is no room for the item.
+func (q *sendQueue) push(item *QueueItem) os.Error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrDestroyed
+	}
+
+	if !q.queue.Enqueue(item) {
+		q.rejected = time.Nanoseconds()
+		return ErrQueueFull
+	}
+	if isControl(item) {
+		q.controls++
+	}
+
+	_ = q.wakeup <- 1
+	return nil
+}
+
+// PushUrgent enqueues item ahead of the WriteQueue: it is not subject to the limits
+// of the WriteQueue nor to the holds, and it is popped before the other items. At
+// most limit such items may be pending. It returns ErrDestroyed if the queue has
+// been closed and ErrQueueFull if there are limit urgent items pending already.
+func (q *sendQueue) pushUrgent(item *QueueItem, limit int) os.Error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrDestroyed
+	}
+
+	if len(q.urgent) >= limit {
+		return ErrQueueFull
+	}
+
+	q.urgent = append(q.urgent, item)
+	_ = q.wakeup <- 1
+	return nil
+}
+
+// PushAll enqueues all the items or none of them. It returns ErrDestroyed if the
+// queue has been closed and ErrQueueFull if the queue can't hold all the items
+// without exceeding limit items.
+func (q *sendQueue) pushAll(items []*QueueItem, limit int) os.Error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrDestroyed
+	}
+
+	if q.queue.Len()+len(items) > limit {
+		q.rejected = time.Nanoseconds()
+		return ErrQueueFull
+	}
+
+	for _, item := range items {
+		if !q.queue.Enqueue(item) {
+			q.rejected = time.Nanoseconds()
+			return ErrQueueFull
+		}
+		if isControl(item) {
+			q.controls++
+		}
+	}
+
+	_ = q.wakeup <- 1
+	return nil
+}
+
+// Pop blocks until the queue holds at least one item that is not held back
+// and then dequeues and returns at most n items, or all of them if n is 0.
+// The urgent items are popped first. While the items are held back, the control
+// items are popped on their own. It returns nil once the queue has been closed.
+func (q *sendQueue) pop(n int) (items []*QueueItem) {
+	for {
+		q.mutex.Lock()
+
+		if q.closed {
+			q.mutex.Unlock()
+			return nil
+		}
+
+		for len(q.urgent) > 0 && (n <= 0 || len(items) < n) {
+			items = append(items, q.urgent[0])
+			q.urgent = q.urgent[1:]
+		}
+
+		held := q.holds > 0 && !q.lifted
+		if q.queue.Len() > 0 && !held {
+			for n <= 0 || len(items) < n {
+				item, ok := q.queue.Dequeue()
+				if !ok {
+					break
+				}
+				if isControl(item) {
+					q.controls--
+				}
+				items = append(items, item)
+			}
+		} else if held && q.controls > 0 {
+			items = append(items, q.popControls()...)
+		}
+
+		if len(items) > 0 {
+			q.busy += len(items)
+			q.popped = time.Nanoseconds()
+			q.mutex.Unlock()
+			return
+		}
+
+		q.mutex.Unlock()
+		<-q.wakeup
+	}
+
+	return
+}
+
+// PopControls dequeues the control items and puts the rest of the items back in
+// the queue in order. It must be called with q.mutex held.
+func (q *sendQueue) popControls() (controls []*QueueItem) {
+	var rest []*QueueItem
+	for n := q.queue.Len(); n > 0; n-- {
+		item, ok := q.queue.Dequeue()
+		if !ok {
+			break
+		}
+		if isControl(item) {
+			controls = append(controls, item)
+		} else {
+			rest = append(rest, item)
+		}
+	}
+	q.controls = 0
+
+	for _, item := range rest {
+		if !q.queue.Enqueue(item) {
+			// there was room for it a moment ago, so rather send it early than lose it
+			controls = append(controls, item)
+		}
+	}
+	return
+}
+
+// Hold holds back the pending and the following items from the pops until
+// release is called. The holds nest: the items are held back until each hold
+// has been released. The control items are not held back, see isControl.
+func (q *sendQueue) hold() {
+	q.mutex.Lock()
+	q.holds++
+	q.mutex.Unlock()
+}
+
+// Release releases a hold. Once all the holds have been released, the pops get
+// the items held back.
+func (q *sendQueue) release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.holds == 0 {
+		return
+	}
+
+	q.holds--
+	if q.holds == 0 {
+		q.lifted = false
+		if !q.closed {
+			_ = q.wakeup <- 1
+		}
+	}
+}
+
+// Lift lets the pops have the items right away until all the current holds have
+// been released.
+func (q *sendQueue) lift() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.holds > 0 && !q.lifted && !q.closed {
+		q.lifted = true
+		_ = q.wakeup <- 1
+	}
+}
+
+// Done marks n popped items as handled, i.e. written or dropped.
+func (q *sendQueue) done(n int) {
+	q.mutex.Lock()
+	q.busy -= n
+	q.mutex.Unlock()
+}
+
+// Status reports whether all the pushed items have been popped and handled and
+// whether the queue has been closed.
+func (q *sendQueue) status() (idle, closed bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.queue.Len() == 0 && len(q.urgent) == 0 && q.busy == 0, q.closed
+}
+
+// Stalled reports whether the queue has refused a push since the last pop and
+// nothing has been popped from it for longer than timeout ns.
+func (q *sendQueue) stalled(timeout int64) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.rejected != 0 && q.rejected >= q.popped && time.Nanoseconds()-q.popped > timeout
+}
+
+// Drain dequeues and returns all the pending items.
+func (q *sendQueue) drain() (items []*QueueItem) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items, q.urgent = q.urgent, nil
+	q.controls = 0
+	for {
+		item, ok := q.queue.Dequeue()
+		if !ok {
+			return
+		}
+		items = append(items, item)
+	}
+
+	return
+}
+
+// Len returns the number of pending items.
+func (q *sendQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.queue.Len() + len(q.urgent)
+}
+
+// Close closes the queue. The pending items are left in place, but no more
+// items can be pushed and the blocking pops will return nil.
+func (q *sendQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.wakeup)
+	}
+}
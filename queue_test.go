@@ -0,0 +1,198 @@
+package socketio
+
+import (
+	"testing"
+	"time"
+)
+
+func popData(q *sendQueue) (data []interface{}) {
+	for _, item := range q.pop(0) {
+		data = append(data, item.Data)
+	}
+	return
+}
+
+func TestSendQueueKeyed(t *testing.T) {
+	q := newSendQueue(NewFIFOQueue(4))
+
+	q.push(&QueueItem{Data: 1, Key: "state"})
+	q.push(&QueueItem{Data: 2, Key: "state"})
+	q.push(&QueueItem{Data: 3})
+	q.push(&QueueItem{Data: 4, Key: "state"})
+	q.push(&QueueItem{Data: 5, Key: "other"})
+
+	// the queue is full now, but the tail can still be replaced
+	if err := q.push(&QueueItem{Data: 6, Key: "other"}); err != nil {
+		t.Fatalf("Expected the tail to be replaced, but got: %s", err)
+	}
+	if err := q.push(&QueueItem{Data: 7}); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, but got: %v", err)
+	}
+
+	data := popData(q)
+	expect := []interface{}{2, 3, 4, 6}
+	if len(data) != len(expect) {
+		t.Fatalf("Expected %v but got %v", expect, data)
+	}
+	for i, v := range expect {
+		if data[i] != v {
+			t.Fatalf("Expected %v but got %v", expect, data)
+		}
+	}
+
+	q.close()
+	if err := q.push(&QueueItem{Data: 8}); err != ErrDestroyed {
+		t.Fatalf("Expected ErrDestroyed, but got: %v", err)
+	}
+	if items := q.pop(0); items != nil {
+		t.Fatalf("Expected nil from a closed queue, but got: %v", items)
+	}
+}
+
+func TestSendQueuePriority(t *testing.T) {
+	q := newSendQueue(NewFIFOQueue(10))
+
+	q.push(&QueueItem{Data: 1})
+	q.push(&QueueItem{Data: 2, Priority: 5})
+	q.push(&QueueItem{Data: 3})
+	q.push(&QueueItem{Data: 4, Priority: 5})
+	q.push(&QueueItem{Data: 5, Priority: 9})
+	q.push(&QueueItem{Data: 6, Priority: -1})
+	q.push(&QueueItem{Data: 7})
+
+	data := popData(q)
+	expect := []interface{}{5, 2, 4, 1, 3, 7, 6}
+	if len(data) != len(expect) {
+		t.Fatalf("Expected %v but got %v", expect, data)
+	}
+	for i, v := range expect {
+		if data[i] != v {
+			t.Fatalf("Expected %v but got %v", expect, data)
+		}
+	}
+}
+
+func TestSendQueueHold(t *testing.T) {
+	q := newSendQueue(NewFIFOQueue(10))
+	popped := make(chan []interface{})
+
+	q.hold()
+	q.push(&QueueItem{Data: 1})
+	go func() {
+		popped <- popData(q)
+	}()
+	q.push(&QueueItem{Data: 2})
+
+	time.Sleep(50e6)
+	if _, ok := <-popped; ok {
+		t.Fatal("Did not expect the held items to be popped")
+	}
+
+	q.release()
+	data := <-popped
+	if len(data) != 2 || data[0] != 1 || data[1] != 2 {
+		t.Fatalf("Expected [1 2] but got %v", data)
+	}
+
+	// the items are held back until every hold has been released
+	q.hold()
+	q.hold()
+	q.push(&QueueItem{Data: 3})
+	go func() {
+		popped <- popData(q)
+	}()
+
+	q.release()
+	time.Sleep(50e6)
+	if _, ok := <-popped; ok {
+		t.Fatal("Did not expect the items to be popped before the last release")
+	}
+
+	q.release()
+	if data = <-popped; len(data) != 1 || data[0] != 3 {
+		t.Fatalf("Expected [3] but got %v", data)
+	}
+}
+
+func TestSendQueueHoldControl(t *testing.T) {
+	q := newSendQueue(NewFIFOQueue(10))
+
+	q.hold()
+	q.push(&QueueItem{Data: 1})
+	q.push(&QueueItem{Data: heartbeat(1)})
+	q.push(&QueueItem{Data: 2})
+	q.push(&QueueItem{Data: ack("a")})
+
+	data := popData(q)
+	if len(data) != 2 || data[0] != heartbeat(1) || data[1] != ack("a") {
+		t.Fatalf("Expected the control items to bypass the hold, but got %v", data)
+	}
+
+	q.release()
+	if data = popData(q); len(data) != 2 || data[0] != 1 || data[1] != 2 {
+		t.Fatalf("Expected [1 2] but got %v", data)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.QueueLength = 4
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+
+	c.Send(1)
+	if err := c.SendBatch([]interface{}{2, 3}); err != nil {
+		t.Fatal("SendBatch:", err)
+	}
+	if err := c.SendBatch([]interface{}{4, 5}); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, but got: %v", err)
+	}
+
+	data := popData(c.queue)
+	if len(data) != 3 || data[0] != 1 || data[1] != 2 || data[2] != 3 {
+		t.Fatalf("Expected [1 2 3] without any of the overflowing batch, but got %v", data)
+	}
+}
+
+// LifoQueue is a WriteQueue that dequeues the latest item first.
+type lifoQueue []*QueueItem
+
+func (q *lifoQueue) Enqueue(item *QueueItem) bool {
+	*q = append(*q, item)
+	return true
+}
+
+func (q *lifoQueue) Dequeue() (*QueueItem, bool) {
+	l := len(*q)
+	if l == 0 {
+		return nil, false
+	}
+
+	item := (*q)[l-1]
+	*q = (*q)[:l-1]
+	return item, true
+}
+
+func (q *lifoQueue) Len() int {
+	return len(*q)
+}
+
+func TestNewQueue(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.NewQueue = func() WriteQueue {
+		return new(lifoQueue)
+	}
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+
+	for i := 1; i <= 3; i++ {
+		c.Send(i)
+	}
+
+	data := popData(c.queue)
+	if len(data) != 3 || data[0] != 3 || data[1] != 2 || data[2] != 1 {
+		t.Fatalf("Expected [3 2 1] but got %v", data)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"crypto/rand"
 	"os"
+	"strings"
 )
 
 // SessionID is just a string for now.
@@ -33,3 +34,19 @@ func NewSessionID() (sid SessionID, err os.Error) {
 	sid = SessionID(b)
 	return
 }
+
+// IsValidSessionID reports whether sid looks like a session id created by
+// NewSessionID, i.e. it is SessionIDLength long and consists of characters from the
+// SessionIDCharset. It can be used as the Config.ValidateSessionID.
+func IsValidSessionID(sid SessionID) bool {
+	if len(sid) != SessionIDLength {
+		return false
+	}
+
+	for i := 0; i < len(sid); i++ {
+		if strings.IndexRune(SessionIDCharset, int(sid[i])) < 0 {
+			return false
+		}
+	}
+	return true
+}
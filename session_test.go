@@ -0,0 +1,21 @@
+package socketio
+
+import (
+	"testing"
+)
+
+func TestIsValidSessionID(t *testing.T) {
+	sid, err := NewSessionID()
+	if err != nil {
+		t.Fatal("NewSessionID:", err)
+	}
+	if !IsValidSessionID(sid) {
+		t.Fatalf("Expected %q to be valid", sid)
+	}
+
+	for _, sid := range []SessionID{"", "abc", "0123456789abcdef0", "0123456789abcde!", "0123456789abcd/."} {
+		if IsValidSessionID(sid) {
+			t.Fatalf("Expected %q to be invalid", sid)
+		}
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"io"
 	"json"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"utf8"
 )
 
@@ -20,6 +22,9 @@ const (
 	sioMessageTypeMessage    = 1
 	sioMessageTypeHeartbeat  = 2
 	sioMessageTypeHandshake  = 3
+
+	// The default of SIOCodec.MaxFrameLength.
+	sioMaxFrameLength = 1 << 20
 )
 
 // SioMessage fulfills the message interface.
@@ -94,10 +99,16 @@ func (sm *sioMessage) JSON() (string, bool) {
 // SIOCodec is the codec used by the official Socket.IO client by LearnBoost.
 // Each message is framed with a prefix and goes like this:
 // <DELIM>DATA-LENGTH<DELIM>[<OPTIONAL DELIM>]DATA.
-type SIOCodec struct{}
+type SIOCodec struct {
+	// Maximum length of a decoded frame, as declared by its length prefix. The
+	// frames declaring more are refused with ErrMalformedPayload, so a client can't
+	// make the decoder buffer without limit. Zero means 1048576.
+	MaxFrameLength int
+}
 
 type sioEncoder struct {
-	elem bytes.Buffer
+	elem        bytes.Buffer
+	annotations bytes.Buffer
 }
 
 func (sc SIOCodec) NewEncoder() Encoder {
@@ -105,10 +116,17 @@ func (sc SIOCodec) NewEncoder() Encoder {
 }
 
 // Encode takes payload, encodes it and writes it to dst. Payload must be one
-// of the following: a heartbeat, a handshake, []byte, string, int or anything
-// than can be marshalled by the default json package. If payload can't be
-// encoded or the writing fails, an error will be returned.
+// of the following: a heartbeat, a handshake, a disconnect, an ack, []byte, string, int or anything
+// than can be marshalled by the default json package. A message payload can be wrapped
+// with annotations, in which case they are written as the annotations of the frame.
+// An empty message is only written if it carries annotations.
+// If payload can't be encoded or the writing fails, an error will be returned.
 func (enc *sioEncoder) Encode(dst io.Writer, payload interface{}) (err os.Error) {
+	var annotations map[string]string
+	if a, ok := payload.(annotated); ok {
+		payload, annotations = a.data, a.annotations
+	}
+
 	enc.elem.Reset()
 
 	switch t := payload.(type) {
@@ -119,49 +137,82 @@ func (enc *sioEncoder) Encode(dst io.Writer, payload interface{}) (err os.Error)
 	case handshake:
 		_, err = fmt.Fprintf(dst, "%d:%d:%s,", sioMessageTypeHandshake, len(t), t)
 
+	case disconnect:
+		_, err = fmt.Fprintf(dst, "%d:0:,", sioMessageTypeDisconnect)
+
+	case ack:
+		err = enc.encodeMessage(dst, map[string]string{AnnotationAck: string(t)}, false, nil)
+
 	case []byte:
-		l := utf8.RuneCount(t)
-		if l == 0 {
+		if len(t) == 0 && len(annotations) == 0 {
 			break
 		}
-		_, err = fmt.Fprintf(dst, "%d:%d::%s,", sioMessageTypeMessage, 1+l, t)
+		err = enc.encodeMessage(dst, annotations, false, t)
 
 	case string:
-		l := utf8.RuneCountInString(t)
-		if l == 0 {
+		if len(t) == 0 && len(annotations) == 0 {
 			break
 		}
-		_, err = fmt.Fprintf(dst, "%d:%d::%s,", sioMessageTypeMessage, 1+l, t)
+		err = enc.encodeMessage(dst, annotations, false, []byte(t))
 
 	case int:
-		s := strconv.Itoa(t)
-		if s == "" {
-			break
-		}
-		_, err = fmt.Fprintf(dst, "%d:%d::%s,", sioMessageTypeMessage, 1+len(s), s)
+		err = enc.encodeMessage(dst, annotations, false, []byte(strconv.Itoa(t)))
 
 	default:
-		data, err := json.Marshal(payload)
-		if len(data) == 0 || err != nil {
+		var data []byte
+		if data, err = json.Marshal(payload); len(data) == 0 || err != nil {
 			break
 		}
-		err = json.Compact(&enc.elem, data)
-		if err != nil {
+		if err = json.Compact(&enc.elem, data); err != nil {
 			break
 		}
+		err = enc.encodeMessage(dst, annotations, true, enc.elem.Bytes())
+	}
+
+	return err
+}
+
+// EncodeMessage writes a message frame carrying data and the given annotations to
+// dst. If json is true, the data is annotated as JSON. The annotation keys and values
+// can't contain colons or newlines and the JSON annotation is reserved.
+func (enc *sioEncoder) encodeMessage(dst io.Writer, annotations map[string]string, json bool, data []byte) os.Error {
+	enc.annotations.Reset()
+	if json {
+		enc.annotations.WriteString(SIOAnnotationJSON + "\n")
+	}
 
-		_, err = fmt.Fprintf(dst, "%d:%d:%s\n:", sioMessageTypeMessage, 2+len(SIOAnnotationJSON)+utf8.RuneCount(enc.elem.Bytes()), SIOAnnotationJSON)
-		if err == nil {
-			_, err = enc.elem.WriteTo(dst)
-			if err == nil {
-				_, err = dst.Write([]byte{','})
+	if len(annotations) > 0 {
+		keys := make([]string, 0, len(annotations))
+		for key := range annotations {
+			keys = append(keys, key)
+		}
+		sort.SortStrings(keys)
+
+		for _, key := range keys {
+			value := annotations[key]
+			if !validAnnotation(key, value) {
+				return os.NewError("invalid annotation: " + key)
+			}
+
+			enc.annotations.WriteString(key)
+			if value != "" {
+				enc.annotations.WriteString(":" + value)
 			}
+			enc.annotations.WriteString("\n")
 		}
 	}
 
+	length := utf8.RuneCount(enc.annotations.Bytes()) + 1 + utf8.RuneCount(data)
+	_, err := fmt.Fprintf(dst, "%d:%d:%s:%s,", sioMessageTypeMessage, length, enc.annotations.Bytes(), data)
 	return err
 }
 
+// ValidAnnotation reports whether key and value can be written as an annotation, i.e.
+// they don't contain colons or newlines and key is neither empty nor reserved.
+func validAnnotation(key, value string) bool {
+	return key != "" && key != SIOAnnotationJSON && strings.IndexAny(key, ":\n") < 0 && strings.IndexAny(value, ":\n") < 0
+}
+
 const (
 	sioDecodeStateBegin = iota
 	sioDecodeStateType
@@ -179,12 +230,19 @@ type sioDecoder struct {
 	msg           *sioMessage
 	key, value    string
 	length, state int
+	maxLength     int
 }
 
 func (sc SIOCodec) NewDecoder(src *bytes.Buffer) Decoder {
+	maxLength := sc.MaxFrameLength
+	if maxLength <= 0 {
+		maxLength = sioMaxFrameLength
+	}
+
 	return &sioDecoder{
-		src:   src,
-		state: sioDecodeStateBegin,
+		src:       src,
+		state:     sioDecodeStateBegin,
+		maxLength: maxLength,
 	}
 }
 
@@ -198,6 +256,11 @@ func (dec *sioDecoder) Reset() {
 	dec.length = 0
 }
 
+// Decode decodes all the complete messages available in the source buffer. An
+// incomplete trailing message is kept in the decoder until the rest of it arrives.
+// A frame with an unknown type, a declared length above MaxFrameLength or a declared
+// length that doesn't match its contents resets the decoder and results in an error,
+// usually ErrMalformedPayload.
 func (dec *sioDecoder) Decode() (messages []Message, err os.Error) {
 	var vec vector.Vector
 	var c int
@@ -223,6 +286,10 @@ L:
 					dec.Reset()
 					return nil, err
 				}
+				if typ > sioMessageTypeHandshake {
+					dec.Reset()
+					return nil, ErrMalformedPayload
+				}
 				dec.msg.typ = uint8(typ)
 				dec.buf.Reset()
 				dec.state = sioDecodeStateLength
@@ -235,6 +302,10 @@ L:
 					dec.Reset()
 					return nil, err
 				}
+				if dec.length < 0 || dec.length > dec.maxLength {
+					dec.Reset()
+					return nil, ErrMalformedPayload
+				}
 				dec.buf.Reset()
 
 				switch dec.msg.typ {
@@ -252,7 +323,11 @@ L:
 			}
 
 		case sioDecodeStateAnnotationKey:
-			dec.length--
+			// the annotations count towards the declared length
+			if dec.length--; dec.length < 0 {
+				dec.Reset()
+				return nil, ErrMalformedPayload
+			}
 
 			switch c {
 			case ':':
@@ -283,7 +358,10 @@ L:
 			}
 
 		case sioDecodeStateAnnotationValue:
-			dec.length--
+			if dec.length--; dec.length < 0 {
+				dec.Reset()
+				return nil, ErrMalformedPayload
+			}
 
 			if c == '\n' || c == ':' {
 				dec.value = dec.buf.String()
@@ -55,6 +55,10 @@ var encodeTests = []encodeTest{
 		handshake("abcdefg"),
 		frame("abcdefg", 3, false),
 	},
+	{
+		disconnect(0),
+		frame("", 0, false),
+	},
 	{
 		true,
 		frame("true", 1, true),
@@ -75,6 +79,14 @@ var encodeTests = []encodeTest{
 		[]byte("hello, world"),
 		frame("hello, world", 1, false),
 	},
+	{
+		annotated{"hello", map[string]string{"ts": "123", "from": "bob"}},
+		"1:22:from:bob\nts:123\n:hello,",
+	},
+	{
+		annotated{true, map[string]string{"ts": "1"}},
+		"1:12:j\nts:1\n:true,",
+	},
 }
 
 
@@ -218,6 +230,122 @@ func TestDecodeStreaming(t *testing.T) {
 	}
 }
 
+func TestEncodeInvalidAnnotations(t *testing.T) {
+	enc := SIOCodec{}.NewEncoder()
+	buf := new(bytes.Buffer)
+
+	for _, meta := range []map[string]string{{"a:b": "c"}, {"a": "b\nc"}, {"j": ""}, {"": "a"}} {
+		buf.Reset()
+		if err := enc.Encode(buf, annotated{"hello", meta}); err == nil {
+			t.Fatalf("Expected an error for %v, but got %q", meta, buf.String())
+		}
+	}
+}
+
+func TestDecodeAnnotations(t *testing.T) {
+	codec := SIOCodec{}
+	buf := new(bytes.Buffer)
+	dec := codec.NewDecoder(buf)
+
+	if err := codec.NewEncoder().Encode(buf, annotated{"hello", map[string]string{"ts": "123", "from": "bob"}}); err != nil {
+		t.Fatal("Encode:", err)
+	}
+	messages, err := dec.Decode()
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if len(messages) != 1 || messages[0].Type() != MessageText || messages[0].Data() != "hello" {
+		t.Fatalf("Expected a single text message \"hello\", but got %v", messages)
+	}
+	if from, ok := messages[0].Annotation("from"); !ok || from != "bob" {
+		t.Fatalf("Expected annotation from=bob, but got %v", messages[0].Annotations())
+	}
+	if ts, ok := messages[0].Annotation("ts"); !ok || ts != "123" {
+		t.Fatalf("Expected annotation ts=123, but got %v", messages[0].Annotations())
+	}
+}
+
+func TestDecodeDisconnect(t *testing.T) {
+	codec := SIOCodec{}
+	buf := bytes.NewBufferString("0:0:,")
+	dec := codec.NewDecoder(buf)
+
+	messages, err := dec.Decode()
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if len(messages) != 1 || messages[0].Type() != MessageDisconnect {
+		t.Fatalf("Expected a single disconnect message, but got %v", messages)
+	}
+}
+
+var malformedDecodeTests = []string{
+	"1:-1::a,",
+	"1:0:,",
+	"1:1:j\n:a,",
+	"1:2:j:a,",
+	"256:1:a,",
+	"4:1:a,",
+	"0:1:a,",
+	"1:1048577::a,",
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	codec := SIOCodec{}
+
+	for _, test := range malformedDecodeTests {
+		t.Logf("in=%q", test)
+
+		buf := bytes.NewBufferString(test)
+		dec := codec.NewDecoder(buf)
+		if messages, err := dec.Decode(); err == nil {
+			t.Fatalf("Expected decode error, but got: %v", messages)
+		}
+
+		// the decoder must be usable after a failure
+		buf.WriteString(frame("wadap!", 1, false))
+		if messages, err := dec.Decode(); err != nil || len(messages) != 1 || messages[0].Data() != "wadap!" {
+			t.Fatalf("Expected to recover after %q, but got: %v, %v", test, messages, err)
+		}
+	}
+}
+
+func TestDecodeMaxFrameLength(t *testing.T) {
+	codec := SIOCodec{MaxFrameLength: 6}
+
+	messages, err := codec.NewDecoder(bytes.NewBufferString(frame("hello", 1, false))).Decode()
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Expected a frame of the maximum length to be decoded, but got %v, %v", messages, err)
+	}
+	if _, err = codec.NewDecoder(bytes.NewBufferString("1:7:")).Decode(); err != ErrMalformedPayload {
+		t.Fatalf("Expected ErrMalformedPayload for a frame declaring too much, but got %v", err)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	codec := SIOCodec{}
+	in := frame("hello, world", 1, false) + frame("313", 2, false) + frame(`{"a":1}`, 1, true)
+
+	for i := 0; i < len(in); i++ {
+		buf := bytes.NewBufferString(in[0:i])
+		dec := codec.NewDecoder(buf)
+
+		messages, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Did not expect errors after writing %q: %s", in[0:i], err)
+		}
+		n := len(messages)
+
+		buf.WriteString(in[i:])
+		if messages, err = dec.Decode(); err != nil {
+			t.Fatalf("Did not expect errors after writing %q: %s", in, err)
+		}
+		if n+len(messages) != 3 {
+			t.Fatalf("Expected 3 messages in total after splitting at %d, but got %d", i, n+len(messages))
+		}
+	}
+}
+
 func BenchmarkIntEncode(b *testing.B) {
 	codec := SIOCodec{}
 	enc := codec.NewEncoder()
@@ -15,13 +15,32 @@
 		- SocketIO.OnConnect
 		- SocketIO.OnDisconnect
 		- SocketIO.OnMessage
+		- SocketIO.OnClosing
+		- SocketIO.OnError
+		- SocketIO.OnOverflow
+		- SocketIO.OnUpgrade
+		- SocketIO.OnDeadLetter
+		- SocketIO.OnVersionRefused
 
 	Other utility-methods include:
 
 		- SocketIO.Mux
 		- SocketIO.Broadcast
+		- SocketIO.BroadcastCount
+		- SocketIO.BroadcastSync
 		- SocketIO.BroadcastExcept
+		- SocketIO.BroadcastExceptMany
+		- SocketIO.BroadcastToTransport
+		- SocketIO.BroadcastSample
+		- SocketIO.BroadcastWhere
 		- SocketIO.GetConn
+		- SocketIO.All
+		- SocketIO.Adopt
+		- SocketIO.ListenAndServeTLS
+		- SocketIO.Shutdown
+		- SocketIO.Stats
+		- SocketIO.Probe
+		- SocketIO.StatsHandler
 		- Conn.Send
 
 	Each new connection will be automatically assigned an unique session id and
@@ -75,24 +94,73 @@ import (
 	"io"
 	"fmt"
 	"http"
+	"log"
 	"os"
+	"rand"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // SocketIO handles transport abstraction and provide the user
 // a handfull of callbacks to observe different events.
 type SocketIO struct {
-	sessions     map[SessionID]*Conn // Holds the outstanding sessions.
-	sessionsLock *sync.RWMutex       // Protects the sessions.
-	config       Config              // Holds the configuration values.
-	muxed        bool                // Is the server muxed already.
+	sessions     map[SessionID]*Conn            // Holds the outstanding sessions.
+	tags         map[string]map[SessionID]*Conn // Indexes the sessions by tag.
+	keys         map[string]map[SessionID]*Conn // Indexes the sessions by user key.
+	sessionsLock *sync.RWMutex                  // Protects the sessions.
+	config       Config                         // Holds the configuration values.
+	loggerLock   *sync.RWMutex                  // Protects the config.Logger.
+	muxed        bool                           // Is the server muxed already.
+	shutdown     bool                           // Is the server shutting down. Protected by sessionsLock.
+	reserved     int                            // The slots reserved for the handshakes in progress. Protected by sessionsLock.
+	evictions    int                            // The evictions the handshakes in progress will make. Protected by sessionsLock.
+	started      int64                          // The creation time of the server.
+	mirrored     chan *mirrored                 // Feeds the config.Mirror. Closed by Shutdown.
+	mirrorLock   *sync.RWMutex                  // Protects mirrored.
+	countChanged chan byte                      // Signals the countWatcher.
+
+	// The counters reported by Stats
+	counters struct {
+		sync.Mutex
+		sent, received int64
+		mirrorDropped  int64 // Number of the messages the mirror has fallen behind on.
+		mirrorLogged   int64 // The time the drops were last logged.
+	}
+
+	// The token buckets of config.MaxPreflightRate by client address
+	preflights struct {
+		sync.Mutex
+		buckets map[string]*tokenBucket
+	}
+
+	// The token bucket of config.AdmissionRate
+	admission struct {
+		sync.Mutex
+		bucket *tokenBucket
+	}
+
+	// The source of randomness
+	random struct {
+		sync.Mutex
+		*rand.Rand
+	}
 
 	// The callbacks set by the user
 	callbacks struct {
-		onConnect    func(*Conn)          // Invoked on new connection.
-		onDisconnect func(*Conn)          // Invoked on a lost connection.
-		onMessage    func(*Conn, Message) // Invoked on a message.
+		onConnect    func(*Conn)                       // Invoked on new connection.
+		onDisconnect func(*Conn)                       // Invoked on a lost connection.
+		onMessage    func(*Conn, Message)              // Invoked on a message.
+		onClosing    func(*Conn) interface{}           // Invoked before the server closes a connection.
+		onError      func(*Conn, interface{}, []byte)  // Invoked when the OnMessage callback panics or decoding fails.
+		onRawIn      func(*Conn, []byte)               // Invoked with the received bytes before decoding.
+		onRawOut     func(*Conn, []byte)               // Invoked with the encoded bytes before writing.
+		onOverflow   func(*Conn, int)                  // Invoked when messages are dropped by a full queue.
+		onUpgrade    func(*Conn, Transport, Transport) // Invoked when a connection switches transports.
+		onDeadLetter func(SessionID, interface{})      // Invoked with the messages left over by a disconnect.
+		onRefused    func(*ProtocolVersionError)       // Invoked when a client of another protocol version is refused.
 	}
 }
 
@@ -105,11 +173,33 @@ func NewSocketIO(config *Config) *SocketIO {
 		config = &DefaultConfig
 	}
 
-	return &SocketIO{
+	sio := &SocketIO{
 		config:       *config,
 		sessions:     make(map[SessionID]*Conn),
+		tags:         make(map[string]map[SessionID]*Conn),
+		keys:         make(map[string]map[SessionID]*Conn),
 		sessionsLock: new(sync.RWMutex),
+		loggerLock:   new(sync.RWMutex),
+		mirrorLock:   new(sync.RWMutex),
+		started:      time.Nanoseconds(),
+	}
+
+	sio.random.Rand = sio.config.Rand
+	if sio.random.Rand == nil {
+		sio.random.Rand = rand.New(rand.NewSource(time.Nanoseconds()))
+	}
+
+	if sio.config.Mirror != nil {
+		sio.mirrored = make(chan *mirrored, mirrorBufferSize)
+		go sio.mirrorer()
+	}
+
+	if sio.config.OnConnectionCountChange != nil {
+		sio.countChanged = make(chan byte, 1)
+		go sio.countWatcher()
 	}
+
+	return sio
 }
 
 // Broadcast schedules data to be sent to each connection.
@@ -117,20 +207,135 @@ func (sio *SocketIO) Broadcast(data interface{}) {
 	sio.BroadcastExcept(nil, data)
 }
 
+// BroadcastCount schedules data to be sent to each connection just like Broadcast
+// and returns the number of connections data was queued to. The connections whose
+// send queue is full are not counted. A queued message is not guaranteed to be
+// delivered, but 0 means that there was nobody to deliver data to.
+func (sio *SocketIO) BroadcastCount(data interface{}) (n int) {
+	for _, c := range sio.conns() {
+		if c.Send(data) == nil {
+			n++
+		}
+	}
+	return
+}
+
+// BroadcastSync schedules data to be sent to each connection just like Broadcast,
+// but it reports the first error returned by Send, e.g. ErrQueueFull. Once it
+// returns, data has been queued to every connection that did not fail. It is still
+// not delivered, so this is merely a deterministic point for sequencing and tests.
+func (sio *SocketIO) BroadcastSync(data interface{}) (err os.Error) {
+	for _, c := range sio.conns() {
+		if e := c.Send(data); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
 // BroadcastExcept schedules data to be sent to each connection except
 // c. It does not care about the type of data, but it must marshallable
 // by the standard json-package.
 func (sio *SocketIO) BroadcastExcept(c *Conn, data interface{}) {
-	sio.sessionsLock.RLock()
-	defer sio.sessionsLock.RUnlock()
-
-	for _, v := range sio.sessions {
+	for _, v := range sio.conns() {
 		if v != c {
 			v.Send(data)
 		}
 	}
 }
 
+// BroadcastExceptMany schedules data to be sent to each connection except the
+// ones in exclude.
+func (sio *SocketIO) BroadcastExceptMany(exclude []*Conn, data interface{}) {
+	skip := make(map[SessionID]bool, len(exclude))
+	for _, c := range exclude {
+		if c != nil {
+			skip[c.sessionid] = true
+		}
+	}
+
+	for _, c := range sio.conns() {
+		if !skip[c.sessionid] {
+			c.Send(data)
+		}
+	}
+}
+
+// BroadcastSample schedules data to be sent to a random sample of the connections:
+// each connection is picked independently with the probability fraction. If
+// fraction is 0 or less, nothing is sent and if it is 1 or more, data is sent to
+// every connection. The randomness comes from config.Rand.
+func (sio *SocketIO) BroadcastSample(fraction float64, data interface{}) {
+	if fraction <= 0 {
+		return
+	}
+
+	conns := sio.conns()
+	if fraction < 1 {
+		sio.random.Lock()
+		sample := conns[:0]
+		for _, c := range conns {
+			if sio.random.Float64() < fraction {
+				sample = append(sample, c)
+			}
+		}
+		conns = sample
+		sio.random.Unlock()
+	}
+
+	for _, c := range conns {
+		c.Send(data)
+	}
+}
+
+// BroadcastToTransport schedules data to be sent to each connection that currently
+// has a live socket of the transport with the given resource, e.g. "websocket".
+// The connections waiting for their client to reconnect are skipped.
+func (sio *SocketIO) BroadcastToTransport(resource string, data interface{}) {
+	for _, c := range sio.conns() {
+		if t := c.transport(); t != nil && t.Resource() == resource {
+			c.Send(data)
+		}
+	}
+}
+
+// BroadcastWhere schedules data to be sent to each connection for which pred returns
+// true and returns the number of connections data was queued to. The predicate is
+// evaluated on a snapshot of the connections without holding the locks of the
+// server, so it may consult e.g. the tags or the transport of the connection, but
+// it must not block, because the broadcast waits for it.
+func (sio *SocketIO) BroadcastWhere(pred func(*Conn) bool, data interface{}) (n int) {
+	for _, c := range sio.conns() {
+		if pred(c) && c.Send(data) == nil {
+			n++
+		}
+	}
+	return
+}
+
+// Conns returns a snapshot of the established connections. If
+// config.StableBroadcastOrder is set, the connections are sorted by session id.
+func (sio *SocketIO) conns() []*Conn {
+	sio.sessionsLock.RLock()
+	conns := make([]*Conn, 0, len(sio.sessions))
+	for _, c := range sio.sessions {
+		conns = append(conns, c)
+	}
+	sio.sessionsLock.RUnlock()
+
+	if sio.config.StableBroadcastOrder {
+		sort.Sort(connsBySessionID(conns))
+	}
+	return conns
+}
+
+// ConnsBySessionID sorts connections by session id.
+type connsBySessionID []*Conn
+
+func (cs connsBySessionID) Len() int           { return len(cs) }
+func (cs connsBySessionID) Less(i, j int) bool { return cs[i].sessionid < cs[j].sessionid }
+func (cs connsBySessionID) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+
 // GetConn digs for a session with sessionid and returns it.
 func (sio *SocketIO) GetConn(sessionid SessionID) (c *Conn) {
 	sio.sessionsLock.RLock()
@@ -139,10 +344,106 @@ func (sio *SocketIO) GetConn(sessionid SessionID) (c *Conn) {
 	return
 }
 
+// IsConnected reports whether there is a session with sessionid and it currently
+// has a live socket. A session that is waiting for its client to reconnect, e.g.
+// between two polls, is known but not connected.
+func (sio *SocketIO) IsConnected(sessionid SessionID) bool {
+	if c := sio.GetConn(sessionid); c != nil {
+		return c.Connected()
+	}
+	return false
+}
+
+// Adopt moves the established connection c from the server it belongs to over to
+// sio without disconnecting it. The connection is removed from its current server
+// without invoking the OnDisconnect callback there and from now on the callbacks of
+// sio are invoked for it instead. Its tags and user key move along with it. The OnConnect callback
+// of sio is not invoked.
+//
+// Both of the servers must live in the same process and they should use compatible
+// codecs and transports, because the connection keeps using the codec of its
+// original server. Also, the client keeps reconnecting to the resource it originally
+// connected to, so unless it stays on a persistent transport (e.g. websocket), the
+// requests coming to that resource must reach sio. The connection counts as a new
+// one against the config.MaxConnections and the config.AdmissionRate of sio. Adopt
+// returns an error if c has been disconnected, if sio is shutting down or if sio
+// has no room for c.
+func (sio *SocketIO) Adopt(c *Conn) os.Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.disconnected {
+		return ErrNotConnected
+	}
+
+	from := c.server()
+	if from == sio {
+		return nil
+	}
+
+	sio.sessionsLock.RLock()
+	shutdown := sio.shutdown
+	sio.sessionsLock.RUnlock()
+	if shutdown {
+		return os.NewError("Adopt: shutting down")
+	}
+
+	s := sio.reserve(false)
+	if s == nil {
+		return os.NewError("Adopt: MaxConnections reached")
+	}
+	if !sio.admit() {
+		sio.sessionsLock.Lock()
+		sio.unreserve(s)
+		sio.sessionsLock.Unlock()
+		return os.NewError("Adopt: AdmissionRate exceeded")
+	}
+
+	from.sessionsLock.Lock()
+	if from.sessions[c.sessionid] != c {
+		from.sessionsLock.Unlock()
+		sio.sessionsLock.Lock()
+		sio.unreserve(s)
+		sio.sessionsLock.Unlock()
+		return os.NewError("Adopt: connection is not established")
+	}
+	tags, key := c.tags, c.key
+	from.sessions[c.sessionid] = nil, false
+	from.untagConn(c)
+	from.unregisterConn(c)
+
+	// under the lock of from, so the tags and the key are not touched meanwhile,
+	// see Conn.lockSessions
+	c.sioLock.Lock()
+	c.sio = sio
+	c.sioLock.Unlock()
+	from.sessionsLock.Unlock()
+	from.countChange()
+
+	sio.sessionsLock.Lock()
+	sio.sessions[c.sessionid] = c
+	sio.unreserve(s)
+	for tag := range tags {
+		sio.tagConn(c, tag)
+	}
+	if key != "" {
+		sio.registerConn(c, key)
+	}
+	sio.sessionsLock.Unlock()
+	sio.countChange()
+
+	sio.Log("sio/adopt: adopted:", c)
+	return nil
+}
+
 // Mux maps resources to the http.ServeMux mux under the resource given.
 // The resource must end with a slash and if the mux is nil, the
 // http.DefaultServeMux is used. It registers handlers for URLs like:
 // <resource><t.resource>[/], e.g. /socket.io/websocket && socket.io/websocket/.
+// It also refuses the requests of the clients of the later, versioned protocols,
+// e.g. /socket.io/1/, with 400 Bad Request, see ProtocolVersionError.
+// The transports are registered in the order of config.Transports and each of
+// them must have a distinct resource.
 func (sio *SocketIO) Mux(resource string, mux *http.ServeMux) os.Error {
 	if mux == nil {
 		mux = http.DefaultServeMux
@@ -156,6 +457,23 @@ func (sio *SocketIO) Mux(resource string, mux *http.ServeMux) os.Error {
 		return os.NewError("Mux: resource must end with a slash")
 	}
 
+	resources := make(map[string]bool)
+	for _, t := range sio.config.Transports {
+		if resources[t.Resource()] {
+			return os.NewError("Mux: duplicate transport resource: " + t.Resource())
+		}
+		resources[t.Resource()] = true
+	}
+
+	// the clients of the Socket.IO 0.7 and later prefix the paths with the protocol
+	// version, e.g. /socket.io/1/, which this server does not speak
+	for _, version := range unsupportedVersions {
+		v := version
+		mux.HandleFunc(resource+v+"/", func(w http.ResponseWriter, req *http.Request) {
+			sio.refuseVersion(v, w, req)
+		})
+	}
+
 	for _, t := range sio.config.Transports {
 		tt := t
 		tresource := resource + tt.Resource()
@@ -171,6 +489,12 @@ func (sio *SocketIO) Mux(resource string, mux *http.ServeMux) os.Error {
 	return nil
 }
 
+// IsMuxed reports whether Mux has been called successfully. Once the server is
+// muxed, the callbacks can't be set anymore.
+func (sio *SocketIO) IsMuxed() bool {
+	return sio.muxed
+}
+
 // OnConnect sets f to be invoked when a new session is established. It passes
 // the established connection as an argument to the callback.
 func (sio *SocketIO) OnConnect(f func(*Conn)) os.Error {
@@ -194,7 +518,8 @@ func (sio *SocketIO) OnDisconnect(f func(*Conn)) os.Error {
 
 // OnMessage sets f to be invoked when a message arrives. It passes
 // the established connection along with the received message as arguments
-// to the callback.
+// to the callback. The messages sent to that connection during the callback are
+// delivered together once the callback returns, see Conn.NoBatch.
 func (sio *SocketIO) OnMessage(f func(*Conn, Message)) os.Error {
 	if sio.muxed {
 		return os.NewError("OnMessage: already muxed")
@@ -203,13 +528,173 @@ func (sio *SocketIO) OnMessage(f func(*Conn, Message)) os.Error {
 	return nil
 }
 
+// OnClosing sets f to be invoked when the server is about to close a connection
+// that still has a live socket, e.g. on Conn.Close or on a missed heartbeat. If f
+// returns a non-nil value, it is encoded and written to the socket before the socket
+// is closed, so the client gets a final notice. OnClosing is invoked before
+// OnDisconnect and it is not invoked when the socket has been lost already. The
+// connection is not locked during f, so f may use it, e.g. to read its Debug info.
+func (sio *SocketIO) OnClosing(f func(*Conn) interface{}) os.Error {
+	if sio.muxed {
+		return os.NewError("OnClosing: already muxed")
+	}
+	sio.callbacks.onClosing = f
+	return nil
+}
+
+// OnError sets f to be invoked when the OnMessage callback panics. It passes the
+// connection, the value recovered from the panic and the stack trace of the panicking
+// goroutine. The panic is recovered, so the connection survives and its following
+// messages are dispatched as usual, unless config.RePanic is set. It is also invoked
+// when the data received from a connection can't be decoded, with the os.Error of
+// the codec, usually ErrMalformedPayload, and a nil stack. Such connection is closed.
+func (sio *SocketIO) OnError(f func(c *Conn, v interface{}, stack []byte)) os.Error {
+	if sio.muxed {
+		return os.NewError("OnError: already muxed")
+	}
+	sio.callbacks.onError = f
+	return nil
+}
+
+// OnRawInbound sets f to be invoked with the raw bytes received from a connection
+// before they are decoded. It is a diagnostic tap for debugging the framing: the
+// bytes are passed as a copy, so f can't corrupt the received data. It is invoked
+// without the locks of the connection, so f may use the connection, but f must not
+// block, since the connection doesn't receive anything until f has returned.
+func (sio *SocketIO) OnRawInbound(f func(*Conn, []byte)) os.Error {
+	if sio.muxed {
+		return os.NewError("OnRawInbound: already muxed")
+	}
+	sio.callbacks.onRawIn = f
+	return nil
+}
+
+// OnRawOutbound sets f to be invoked with the encoded bytes of the messages queued
+// for a connection right before they are written to the socket. Like OnRawInbound,
+// it is a diagnostic tap, the bytes are passed as a copy and f must not block,
+// since the connection doesn't write anything until f has returned.
+func (sio *SocketIO) OnRawOutbound(f func(*Conn, []byte)) os.Error {
+	if sio.muxed {
+		return os.NewError("OnRawOutbound: already muxed")
+	}
+	sio.callbacks.onRawOut = f
+	return nil
+}
+
+// OnOverflow sets f to be invoked when messages sent to a connection are dropped,
+// because its send queue has reached config.QueueLength. It passes the connection
+// and the number of the dropped messages. A connection whose queue keeps overflowing
+// is a slow consumer, so f is the place to alert on them or to close them.
+func (sio *SocketIO) OnOverflow(f func(c *Conn, dropped int)) os.Error {
+	if sio.muxed {
+		return os.NewError("OnOverflow: already muxed")
+	}
+	sio.callbacks.onOverflow = f
+	return nil
+}
+
+// OnUpgrade sets f to be invoked when a client reconnects to its session through
+// another transport than before, e.g. when it upgrades from xhr-polling to
+// websocket. It passes the connection along with the previous and the new transport.
+// The reconnects through the same transport don't invoke f. Since the new socket is
+// already in use, f is invoked in a goroutine of its own.
+func (sio *SocketIO) OnUpgrade(f func(c *Conn, from, to Transport)) os.Error {
+	if sio.muxed {
+		return os.NewError("OnUpgrade: already muxed")
+	}
+	sio.callbacks.onUpgrade = f
+	return nil
+}
+
+// OnDeadLetter sets f to be invoked for each message that was still queued for a
+// connection when the connection was disconnected, e.g. when the client did not
+// reconnect within the reconnect timeout. It passes the session id of the connection
+// and the data given to Send, so the messages can be delivered by other means, e.g.
+// as push notifications. The heartbeats and the other internal messages are skipped.
+func (sio *SocketIO) OnDeadLetter(f func(id SessionID, data interface{})) os.Error {
+	if sio.muxed {
+		return os.NewError("OnDeadLetter: already muxed")
+	}
+	sio.callbacks.onDeadLetter = f
+	return nil
+}
+
+// OnVersionRefused sets f to be invoked when the request of a client speaking an
+// unsupported version of the protocol is refused, e.g. to alert on outdated clients.
+// There is no connection for such a client, so f is passed the error only.
+func (sio *SocketIO) OnVersionRefused(f func(err *ProtocolVersionError)) os.Error {
+	if sio.muxed {
+		return os.NewError("OnVersionRefused: already muxed")
+	}
+	sio.callbacks.onRefused = f
+	return nil
+}
+
+// Shutdown gracefully closes all the connections. New connections are refused from
+// now on. Each connection is sent a disconnect notice, which is then flushed along
+// with the other pending messages before the connection is closed. The flushing is
+// bounded by timeout (in ns) that applies to all the connections together. If some
+// of the connections could not be flushed in time, they are closed anyway and an
+// error reporting their number is returned.
+func (sio *SocketIO) Shutdown(timeout int64) os.Error {
+	deadline := time.Nanoseconds() + timeout
+
+	sio.sessionsLock.Lock()
+	sio.shutdown = true
+	sio.sessionsLock.Unlock()
+
+	conns := sio.conns()
+
+	flushed := make(chan bool)
+	for _, c := range conns {
+		go func(c *Conn) {
+			ok := c.Send(disconnect(0)) == nil && c.flush(deadline)
+			c.Close()
+			flushed <- ok
+		}(c)
+	}
+
+	var failed int
+	for _ = range conns {
+		if !<-flushed {
+			failed++
+		}
+	}
+
+	// the mirrorer ends once it has mirrored the rest of the messages
+	sio.mirrorLock.Lock()
+	if sio.mirrored != nil {
+		close(sio.mirrored)
+		sio.mirrored = nil
+	}
+	sio.mirrorLock.Unlock()
+
+	if failed > 0 {
+		return os.NewError(fmt.Sprintf("Shutdown: %d of %d connections could not be flushed in time", failed, len(conns)))
+	}
+	return nil
+}
+
+// SetLogger replaces the logger of a running server. If l is nil, nothing is logged.
+func (sio *SocketIO) SetLogger(l *log.Logger) {
+	sio.loggerLock.Lock()
+	sio.config.Logger = l
+	sio.loggerLock.Unlock()
+}
+
 func (sio *SocketIO) Log(v ...interface{}) {
+	sio.loggerLock.RLock()
+	defer sio.loggerLock.RUnlock()
+
 	if sio.config.Logger != nil {
 		sio.config.Logger.Println(v...)
 	}
 }
 
 func (sio *SocketIO) Logf(format string, v ...interface{}) {
+	sio.loggerLock.RLock()
+	defer sio.loggerLock.RUnlock()
+
 	if sio.config.Logger != nil {
 		sio.config.Logger.Printf(format, v...)
 	}
@@ -230,7 +715,12 @@ func (sio *SocketIO) handle(t Transport, w http.ResponseWriter, req *http.Reques
 	var err os.Error
 
 	if origin, ok := req.Header["Origin"]; ok {
-		if _, ok = sio.verifyOrigin(origin); !ok {
+		if sio.config.VerifyOrigin != nil {
+			ok = sio.config.VerifyOrigin(origin)
+		} else {
+			_, ok = sio.verifyOrigin(origin)
+		}
+		if !ok {
 			sio.Log("sio/handle: unauthorized origin:", origin)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
@@ -243,6 +733,11 @@ func (sio *SocketIO) handle(t Transport, w http.ResponseWriter, req *http.Reques
 
 	switch req.Method {
 	case "OPTIONS":
+		if !sio.allowPreflight(w.RemoteAddr()) {
+			sio.Log("sio/handle: refusing a preflight: MaxPreflightRate exceeded:", w.RemoteAddr())
+			w.WriteHeader(statusTooManyRequests)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		return
 
@@ -254,6 +749,29 @@ func (sio *SocketIO) handle(t Transport, w http.ResponseWriter, req *http.Reques
 		return
 	}
 
+	if req.Method == "POST" && sio.config.MaxPostBytes > 0 {
+		if req.ContentLength > sio.config.MaxPostBytes {
+			sio.Log("sio/handle: refusing a too large POST:", req.ContentLength)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// the length of a chunked body is not known in advance
+		body := new(bytes.Buffer)
+		if _, err = body.ReadFrom(io.LimitReader(req.Body, sio.config.MaxPostBytes+1)); err != nil {
+			sio.Log("sio/handle: unable to read a POST:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if int64(body.Len()) > sio.config.MaxPostBytes {
+			sio.Log("sio/handle: refusing a too large POST: more than", sio.config.MaxPostBytes)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = readCloser{body, req.Body}
+		req.ContentLength = int64(body.Len())
+	}
+
 	// TODO: fails if the session id matches the transport
 	if i := strings.LastIndex(req.URL.Path, t.Resource()); i >= 0 {
 		pathLen := len(req.URL.Path)
@@ -264,22 +782,78 @@ func (sio *SocketIO) handle(t Transport, w http.ResponseWriter, req *http.Reques
 		parts = strings.Split(req.URL.Path[i:pathLen], "/", -1)
 	}
 
+	if sio.config.AllowForceTransport {
+		if resource := req.FormValue("forceTransport"); resource != "" {
+			if t = sio.transport(resource); t == nil {
+				sio.Log("sio/handle: unable to force an unknown transport:", resource)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
 	switch len(parts) {
 	case 1:
 		// only resource was present, so create a new connection
+		sio.sessionsLock.RLock()
+		shutdown := sio.shutdown
+		sio.sessionsLock.RUnlock()
+
+		if shutdown {
+			sio.Log("sio/handle: refusing a new connection: shutting down")
+			w.SetHeader("Retry-After", sio.retryAfter())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// before the connection is created, so the refused ones cost nothing
+		s := sio.reserve(sio.config.CapacityPolicy == EvictOldest)
+		if s == nil {
+			sio.Log("sio/handle: refusing a new connection: MaxConnections reached")
+			w.SetHeader("Retry-After", sio.retryAfter())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// the slot is taken by onConnect, unless the handshake fails
+		defer func() {
+			sio.sessionsLock.Lock()
+			sio.unreserve(s)
+			sio.sessionsLock.Unlock()
+		}()
+
+		// last, so the handshakes refused anyway don't spend the tokens
+		if !sio.admit() {
+			sio.Log("sio/handle: refusing a new connection: AdmissionRate exceeded")
+			w.SetHeader("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
 		c, err = newConn(sio)
 		if err != nil {
 			sio.Log("sio/handle: unable to create a new connection:", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		c.slot = s
 
 	case 2:
 		fallthrough
 
 	case 3:
 		// session id was present
-		c = sio.GetConn(SessionID(parts[1]))
+		sessionid := SessionID(parts[1])
+		if sio.config.ValidateSessionID != nil && !sio.config.ValidateSessionID(sessionid) {
+			sio.Logf("sio/handle: invalid session id: %q", sessionid)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if c = sio.GetConn(sessionid); c == nil && sio.config.OnUnknownSession != nil {
+			sio.Logf("sio/handle: unknown session id: %q", sessionid)
+			sio.config.OnUnknownSession(w, req)
+			return
+		}
 	}
 
 	// we should now have a connection
@@ -290,20 +864,183 @@ func (sio *SocketIO) handle(t Transport, w http.ResponseWriter, req *http.Reques
 	}
 
 	// pass the http conn/req pair to the connection
-	if err = c.handle(t, w, req); err != nil {
+	if err = c.handle(t, sio.tcpOptions(t, w), req); err != nil {
 		sio.Logf("sio/handle: conn/handle: %s: %s", c, err)
 		w.WriteHeader(http.StatusUnauthorized)
 	}
 }
 
+// TCPOptions wraps w so that the TCP options are applied to the connections the
+// websocket and flashsocket transports hijack from it.
+func (sio *SocketIO) tcpOptions(t Transport, w http.ResponseWriter) http.ResponseWriter {
+	switch t.(type) {
+	case *websocketTransport, *flashsocketTransport:
+		return &tcpOptionsWriter{w, sio.config.TCPNoDelay, sio.config.TCPKeepAlive}
+	}
+	return w
+}
+
+// NewQueue creates the WriteQueue for a new connection.
+func (sio *SocketIO) newQueue() WriteQueue {
+	if sio.config.NewQueue != nil {
+		return sio.config.NewQueue()
+	}
+	return NewFIFOQueue(sio.config.QueueLength)
+}
+
+// Transport returns the configured transport with the given resource or nil.
+func (sio *SocketIO) transport(resource string) Transport {
+	for _, t := range sio.config.Transports {
+		if t.Resource() == resource {
+			return t
+		}
+	}
+	return nil
+}
+
+// The protocol versions the clients declare in the paths of their requests. This
+// server speaks the unversioned protocol of Socket.IO 0.6 only.
+var unsupportedVersions = []string{"1"}
+
+// ProtocolVersionError records a request of a client that speaks an unsupported
+// version of the protocol.
+type ProtocolVersionError struct {
+	Version    string // The version declared by the client.
+	RemoteAddr string // The address of the client.
+}
+
+func (e *ProtocolVersionError) String() string {
+	return "unsupported protocol version " + e.Version + " from " + e.RemoteAddr
+}
+
+// RefuseVersion refuses a request of a client speaking the protocol version,
+// logs it and passes it to the user's OnVersionRefused callback.
+func (sio *SocketIO) refuseVersion(version string, w http.ResponseWriter, req *http.Request) {
+	err := &ProtocolVersionError{version, w.RemoteAddr()}
+	sio.Log("sio/handle:", err)
+	sio.onVersionRefused(err)
+
+	w.SetHeader("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte("socket.io: unsupported protocol version " + version + ", this server speaks the protocol of 0.6\n"))
+}
+
+// Slot is a place reserved for a new connection within MaxConnections.
+type slot struct {
+	reserved bool // Whether the slot still counts in sio.reserved.
+	evicts   bool // Whether the connection evicts the oldest one once connected.
+}
+
+// Reserve reserves a slot for a new connection within the configured
+// MaxConnections. The slots of the handshakes in progress count against the limit
+// just like the established connections, so that the concurrent handshakes can't
+// exceed it. It returns nil if there is no slot left. The slot is taken over by
+// the connection it is given to in onConnect, or it must be given back with
+// unreserve.
+//
+// If there is no slot left, but evict is set and there is an established connection
+// that has not been picked for an eviction yet, the slot is reserved anyway and the
+// new connection evicts the least recently active connection once it has connected,
+// see onConnect. This way no one is evicted for a handshake that fails.
+func (sio *SocketIO) reserve(evict bool) *slot {
+	sio.sessionsLock.Lock()
+	defer sio.sessionsLock.Unlock()
+
+	s := &slot{reserved: true}
+	if max := sio.config.MaxConnections; max > 0 && len(sio.sessions)+sio.reserved >= max {
+		if !evict || len(sio.sessions) <= sio.evictions {
+			return nil
+		}
+		sio.evictions++
+		s.evicts = true
+	}
+	sio.reserved++
+	return s
+}
+
+// Unreserve gives back the slot s, unless it has been taken over already. It
+// must be called with sio.sessionsLock held.
+func (sio *SocketIO) unreserve(s *slot) {
+	if s.reserved {
+		s.reserved = false
+		sio.reserved--
+	}
+	if s.evicts {
+		s.evicts = false
+		sio.evictions--
+	}
+}
+
+// Admit reports whether a new connection may be created within the configured
+// AdmissionRate.
+func (sio *SocketIO) admit() bool {
+	rate := float64(sio.config.AdmissionRate)
+	if rate <= 0 {
+		return true
+	}
+	now := time.Nanoseconds()
+
+	sio.admission.Lock()
+	defer sio.admission.Unlock()
+
+	if sio.admission.bucket == nil {
+		sio.admission.bucket = newTokenBucket(rate, now)
+	}
+	return sio.admission.bucket.take(rate, now)
+}
+
+// EvictOldest closes the least recently active connection other than except. It
+// returns false if there was no connection to close.
+func (sio *SocketIO) evictOldest(except *Conn) bool {
+	var oldest *Conn
+	var oldestActivity int64
+
+	for _, c := range sio.conns() {
+		if c == except {
+			continue
+		}
+		if activity := c.lastActivity(); oldest == nil || activity < oldestActivity {
+			oldest, oldestActivity = c, activity
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	sio.Log("sio/handle: evicting the least recently active connection:", oldest)
+	oldest.Close()
+	return true
+}
+
+// RetryAfter returns the value of the Retry-After header sent along with the refused
+// requests. It is the reconnect timeout in seconds, but at least one second.
+func (sio *SocketIO) retryAfter() string {
+	if secs := sio.config.ReconnectTimeout / 1e9; secs > 1 {
+		return strconv.Itoa64(secs)
+	}
+	return "1"
+}
+
 // OnConnect is invoked by a connection when a new connection has been
 // established succesfully. The establised connection is passed as an
 // argument. It stores the connection and calls the user's OnConnect callback.
 func (sio *SocketIO) onConnect(c *Conn) {
 	sio.sessionsLock.Lock()
 	sio.sessions[c.sessionid] = c
+	var evict bool
+	if c.slot != nil {
+		evict = c.slot.evicts
+		sio.unreserve(c.slot)
+		c.slot = nil
+	}
 	sio.sessionsLock.Unlock()
 
+	if evict {
+		sio.evictOldest(c)
+	}
+	sio.countChange()
+
 	if sio.callbacks.onConnect != nil {
 		sio.callbacks.onConnect(c)
 	}
@@ -314,7 +1051,10 @@ func (sio *SocketIO) onConnect(c *Conn) {
 func (sio *SocketIO) onDisconnect(c *Conn) {
 	sio.sessionsLock.Lock()
 	sio.sessions[c.sessionid] = nil, false
+	sio.untagConn(c)
+	sio.unregisterConn(c)
 	sio.sessionsLock.Unlock()
+	sio.countChange()
 
 	if sio.callbacks.onDisconnect != nil {
 		sio.callbacks.onDisconnect(c)
@@ -329,6 +1069,119 @@ func (sio *SocketIO) onMessage(c *Conn, msg Message) {
 	}
 }
 
+// OnError is invoked by a connection when the user's OnMessage callback has panicked
+// or the received data can't be decoded. It passes the recovered value or the error
+// and the stack trace to the user's OnError callback.
+func (sio *SocketIO) onError(c *Conn, v interface{}, stack []byte) {
+	if sio.callbacks.onError != nil {
+		sio.callbacks.onError(c, v, stack)
+	}
+}
+
+// OnOverflow is invoked by a connection when its send queue has refused messages.
+// It passes the number of the dropped messages to the user's OnOverflow callback.
+func (sio *SocketIO) onOverflow(c *Conn, dropped int) {
+	if sio.callbacks.onOverflow != nil {
+		sio.callbacks.onOverflow(c, dropped)
+	}
+}
+
+// OnUpgrade is invoked by a connection when it has been bound to a socket of another
+// transport. It passes the transports to the user's OnUpgrade callback.
+func (sio *SocketIO) onUpgrade(c *Conn, from, to Transport) {
+	if sio.callbacks.onUpgrade != nil {
+		sio.callbacks.onUpgrade(c, from, to)
+	}
+}
+
+// OnDeadLetter is invoked by a connection with each message it could not deliver
+// before it was disconnected. It passes the message to the user's OnDeadLetter callback.
+func (sio *SocketIO) onDeadLetter(id SessionID, data interface{}) {
+	if sio.callbacks.onDeadLetter != nil {
+		sio.callbacks.onDeadLetter(id, data)
+	}
+}
+
+// OnVersionRefused is invoked when the request of a client speaking an unsupported
+// version of the protocol has been refused. It passes err to the user's callback.
+func (sio *SocketIO) onVersionRefused(err *ProtocolVersionError) {
+	if sio.callbacks.onRefused != nil {
+		sio.callbacks.onRefused(err)
+	}
+}
+
+// OnRaw passes a copy of data to f, if f is set.
+func (sio *SocketIO) onRaw(f func(*Conn, []byte), c *Conn, data []byte) {
+	if f != nil {
+		raw := make([]byte, len(data))
+		copy(raw, data)
+		f(c, raw)
+	}
+}
+
+// OnClosing is invoked by a connection when it is about to be closed by the server.
+// It returns the user's farewell message or nil.
+func (sio *SocketIO) onClosing(c *Conn) interface{} {
+	if sio.callbacks.onClosing != nil {
+		return sio.callbacks.onClosing(c)
+	}
+	return nil
+}
+
+// Mirrored is a message waiting to be passed to config.Mirror.
+type mirrored struct {
+	direction int
+	c         *Conn
+	data      interface{}
+}
+
+// The number of messages that may be waiting to be mirrored.
+const mirrorBufferSize = 1024
+
+// Mirror hands a message over to the mirrorer. If the mirrorer has fallen behind,
+// the message is dropped and counted, see Stats.MirrorDropped.
+func (sio *SocketIO) mirror(direction int, c *Conn, data interface{}) {
+	sio.mirrorLock.RLock()
+	defer sio.mirrorLock.RUnlock()
+
+	if sio.mirrored == nil {
+		return
+	}
+
+	if ok := sio.mirrored <- &mirrored{direction, c, data}; !ok {
+		sio.mirrorDropped()
+	}
+}
+
+// MirrorDropped counts a message dropped by mirror. The drops are logged at most
+// once a second, so an overloaded mirror doesn't flood the log as well.
+func (sio *SocketIO) mirrorDropped() {
+	now := time.Nanoseconds()
+
+	sio.counters.Lock()
+	sio.counters.mirrorDropped++
+	dropped := sio.counters.mirrorDropped
+	logged := now-sio.counters.mirrorLogged < 1e9
+	if !logged {
+		sio.counters.mirrorLogged = now
+	}
+	sio.counters.Unlock()
+
+	if !logged {
+		sio.Logf("sio/mirror: mirror is falling behind, dropped %d messages so far", dropped)
+	}
+}
+
+// Mirrorer passes the mirrored messages to the user's config.Mirror.
+func (sio *SocketIO) mirrorer() {
+	for m := range sio.mirrored {
+		sio.config.Mirror(m.direction, m.c, m.data)
+	}
+}
+
+// VerifyOrigin matches the origin of a request against the config.Origins and
+// returns the matching entry. An origin without a port matches the entries with the
+// default port of its scheme, i.e. 80 for http and ws and 443 for https and wss.
 func (sio *SocketIO) verifyOrigin(reqOrigin string) (string, bool) {
 	if sio.config.Origins == nil {
 		return "", false
@@ -348,7 +1201,7 @@ func (sio *SocketIO) verifyOrigin(reqOrigin string) (string, bool) {
 				return o, true
 			}
 			if len(host) < 2 {
-				switch url.Scheme {
+				switch strings.ToLower(url.Scheme) {
 				case "http", "ws":
 					if origin[1] == "80" {
 						return o, true
@@ -398,25 +1251,83 @@ func (sio *SocketIO) generatePolicyFile() []byte {
 	return buf.Bytes()
 }
 
-func (sio *SocketIO) ListenAndServeFlashPolicy(laddr string) os.Error {
-	var listener net.Listener
+// ListenAndServeTLS listens on the TCP network address addr and serves the requests
+// to mux over TLS, using the certificate and the matching private key in certFile
+// and keyFile. The mux should be the one given to Mux, so the socket.io resources are
+// served over https and wss. If mux is nil, http.DefaultServeMux is used. Remember
+// to allow the secure origins, e.g. "example.com:443", in config.Origins.
+func (sio *SocketIO) ListenAndServeTLS(addr, certFile, keyFile string, mux *http.ServeMux) os.Error {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
 
+	if !sio.muxed {
+		sio.Log("sio/ListenAndServeTLS: serving before Mux has been called")
+	}
+	return http.ListenAndServeTLS(addr, certFile, keyFile, mux)
+}
+
+// The time (in ns) a client of the flash policy server has to send its request,
+// so that the idle clients don't hold on to the FlashPolicyWorkers.
+var flashPolicyReadTimeout int64 = 5e9
+
+// ListenAndServeFlashPolicy listens on the TCP network address laddr and serves
+// the flash socket policy file generated from config.Origins, see ServeFlashPolicy.
+func (sio *SocketIO) ListenAndServeFlashPolicy(laddr string) os.Error {
 	listener, err := net.Listen("tcp", laddr)
 	if err != nil {
 		return err
 	}
 
+	return sio.ServeFlashPolicy(listener)
+}
+
+// ServeFlashPolicy accepts connections on the listener and answers their
+// <policy-file-request> with the flash socket policy file generated from
+// config.Origins. This makes it possible to use a listener that has been created
+// elsewhere, e.g. one inherited through socket activation. At most
+// config.FlashPolicyWorkers connections are served at a time, the excess ones are
+// closed right away, and a connection that does not send its request in time is
+// closed as well. The temporary errors of accepting, e.g. running out of file
+// descriptors, are logged and the accepting goes on. It returns once accepting
+// fails for good, e.g. when the listener has been closed.
+func (sio *SocketIO) ServeFlashPolicy(listener net.Listener) os.Error {
 	policy := sio.generatePolicyFile()
 
+	var workers chan byte
+	if sio.config.FlashPolicyWorkers > 0 {
+		workers = make(chan byte, sio.config.FlashPolicyWorkers)
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			sio.Log("ServeFlashsocketPolicy:", err)
-			continue
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				// e.g. out of file descriptors, so back off for a while
+				time.Sleep(10e6)
+				continue
+			}
+			return err
+		}
+
+		if workers != nil {
+			if ok := workers <- 1; !ok {
+				sio.Log("ServeFlashsocketPolicy: refusing", conn.RemoteAddr(), "FlashPolicyWorkers busy")
+				conn.Close()
+				continue
+			}
 		}
 
 		go func() {
 			defer conn.Close()
+			if workers != nil {
+				defer func() { <-workers }()
+			}
+
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetReadTimeout(flashPolicyReadTimeout)
+			}
 
 			buf := make([]byte, 20)
 			if _, err := io.ReadFull(conn, buf); err != nil {
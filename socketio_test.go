@@ -1,7 +1,16 @@
 package socketio
 
 import (
+	"bufio"
+	"bytes"
 	"http"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"rand"
+	"strings"
 	"testing"
 	"time"
 	"fmt"
@@ -154,3 +163,1102 @@ func TestWebsocket(t *testing.T) {
 
 	finished <- true
 }
+
+func TestMuxDuplicateTransports(t *testing.T) {
+	config := DefaultConfig
+	config.Transports = []Transport{
+		NewXHRPollingTransport(10e9, 5e9),
+		NewWebsocketTransport(0, 5e9),
+		NewXHRPollingTransport(0, 5e9),
+	}
+
+	sio := NewSocketIO(&config)
+	if err := sio.Mux("/socket.io/", http.NewServeMux()); err == nil {
+		t.Fatal("Expected Mux to reject duplicate transport resources")
+	}
+
+	if sio.IsMuxed() {
+		t.Fatal("Expected a failed Mux to leave the server unmuxed")
+	}
+
+	config.Transports = config.Transports[0:2]
+	sio = NewSocketIO(&config)
+	if err := sio.Mux("/socket.io/", http.NewServeMux()); err != nil {
+		t.Fatal("Mux:", err)
+	}
+	if !sio.IsMuxed() {
+		t.Fatal("Expected the server to be muxed")
+	}
+}
+
+// TestResponseWriter is a http.ResponseWriter that records the response.
+type testResponseWriter struct {
+	status  int
+	headers map[string]string
+	body    bytes.Buffer
+}
+
+func newTestResponseWriter() *testResponseWriter {
+	return &testResponseWriter{headers: make(map[string]string)}
+}
+
+func (w *testResponseWriter) RemoteAddr() string {
+	return "127.0.0.1:31337"
+}
+
+func (w *testResponseWriter) UsingTLS() bool {
+	return false
+}
+
+func (w *testResponseWriter) SetHeader(key, value string) {
+	w.headers[key] = value
+}
+
+func (w *testResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *testResponseWriter) Write(p []byte) (int, os.Error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *testResponseWriter) Flush() {}
+
+func (w *testResponseWriter) Hijack() (io.ReadWriteCloser, *bufio.ReadWriter, os.Error) {
+	return nil, nil, os.NewError("hijack not supported")
+}
+
+func newTestRequest(method, rawurl string) *http.Request {
+	url, err := http.ParseURL(rawurl)
+	if err != nil {
+		panic(err)
+	}
+	return &http.Request{
+		Method: method,
+		RawURL: rawurl,
+		URL:    url,
+		Header: make(map[string]string),
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	config := DefaultConfig
+	config.MaxConnections = 2
+	config.Logger = NOPLogger
+	config.Transports = []Transport{testTransport("test")}
+	sio := NewSocketIO(&config)
+
+	responses := make(chan *testResponseWriter)
+	for i := 0; i <= config.MaxConnections; i++ {
+		go func() {
+			w := newTestResponseWriter()
+			sio.handle(config.Transports[0], w, newTestRequest("GET", "/socket.io/test"))
+			responses <- w
+		}()
+	}
+
+	refused := 0
+	for i := 0; i <= config.MaxConnections; i++ {
+		if w := <-responses; w.status == http.StatusServiceUnavailable {
+			refused++
+			if _, ok := w.headers["Retry-After"]; !ok {
+				t.Fatal("Expected a Retry-After header")
+			}
+		}
+	}
+
+	if refused != 1 {
+		t.Fatalf("Expected a single handshake to be refused, but got %d", refused)
+	}
+	if len(sio.sessions) != config.MaxConnections || sio.reserved != 0 {
+		t.Fatalf("Expected %d sessions and no reserved slots, but got %d and %d", config.MaxConnections, len(sio.sessions), sio.reserved)
+	}
+}
+
+func TestMaxConnectionsNoConn(t *testing.T) {
+	created := 0
+	config := DefaultConfig
+	config.MaxConnections = 1
+	config.Logger = NOPLogger
+	config.Transports = []Transport{testTransport("test")}
+	config.NewQueue = func() WriteQueue {
+		created++
+		return NewFIFOQueue(config.QueueLength)
+	}
+	sio := NewSocketIO(&config)
+	newTestConn(t, sio)
+	created = 0
+
+	w := newTestResponseWriter()
+	sio.handle(config.Transports[0], w, newTestRequest("GET", "/socket.io/test"))
+	if w.status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d but got %d", http.StatusServiceUnavailable, w.status)
+	}
+	if created != 0 {
+		t.Fatalf("Expected no connection to be created for a refused handshake, but got %d", created)
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	from, to := NewSocketIO(&config), NewSocketIO(&config)
+	from.OnDisconnect(func(c *Conn) {
+		t.Fatal("Did not expect OnDisconnect to be invoked on the original server")
+	})
+	disconnected := make(chan *Conn, 1)
+	to.OnDisconnect(func(c *Conn) {
+		disconnected <- c
+	})
+
+	c := newTestConn(t, from)
+	c.AddTag("tenant:acme")
+
+	if err := to.Adopt(c); err != nil {
+		t.Fatal("Adopt:", err)
+	}
+	if from.GetConn(c.sessionid) != nil || from.CountByTag("tenant:acme") != 0 {
+		t.Fatal("Expected the connection to be removed from the original server")
+	}
+	if to.GetConn(c.sessionid) != c || to.CountByTag("tenant:acme") != 1 {
+		t.Fatal("Expected the connection to be registered under the new server")
+	}
+
+	c.Close()
+	if d, ok := <-disconnected; !ok || d != c {
+		t.Fatal("Expected OnDisconnect to be invoked on the new server")
+	}
+	if err := from.Adopt(c); err == nil {
+		t.Fatal("Expected adopting a disconnected connection to fail")
+	}
+
+	// the limits of the new server apply
+	config.MaxConnections = 1
+	full := NewSocketIO(&config)
+	newTestConn(t, full)
+	c = newTestConn(t, from)
+	if err := full.Adopt(c); err == nil {
+		t.Fatal("Expected adopting a connection by a server at capacity to fail")
+	}
+	if from.GetConn(c.sessionid) != c || c.server() != from {
+		t.Fatal("Expected the refused connection to stay on the original server")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	// the flusher of the stuck connection is not running
+	flushed, stuck := newTestConn(t, sio), newTestConn(t, sio)
+	flushed.Send("hello")
+	stuck.Send("hello")
+	go flushed.flusher()
+
+	start := time.Nanoseconds()
+	if err := sio.Shutdown(100e6); err == nil {
+		t.Fatal("Expected an error for the connection that could not be flushed")
+	}
+	if elapsed := time.Nanoseconds() - start; elapsed < 100e6 {
+		t.Fatalf("Expected Shutdown to wait for the deadline, but it took %dns", elapsed)
+	}
+
+	if written := flushed.socket.(*testSocket).Buffer.String(); written != frame("hello", 1, false)+"0:0:," {
+		t.Fatalf("Expected the pending message and the disconnect notice to be flushed, but got %q", written)
+	}
+	if stuck.socket.(*testSocket).Buffer.Len() != 0 {
+		t.Fatal("Did not expect anything to be written to the stuck connection")
+	}
+	for _, c := range []*Conn{flushed, stuck} {
+		if c.Connected() || !c.socket.(*testSocket).closed {
+			t.Fatal("Expected the connections to be closed after the deadline")
+		}
+	}
+
+	w := newTestResponseWriter()
+	sio.handle(testTransport("test"), w, newTestRequest("GET", "/socket.io/test"))
+	if w.status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a new connection to be refused, but got status %d", w.status)
+	}
+}
+
+func TestIsConnected(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	c := newTestConn(t, sio)
+	if !sio.IsConnected(c.sessionid) || !c.Connected() {
+		t.Fatal("Expected an established connection to be connected")
+	}
+
+	// waiting for the client to reconnect
+	c.mutex.Lock()
+	c.online = false
+	c.mutex.Unlock()
+	if sio.IsConnected(c.sessionid) || c.Connected() || sio.GetConn(c.sessionid) != c {
+		t.Fatal("Expected a known connection without a socket not to be connected")
+	}
+
+	c.mutex.Lock()
+	c.online = true
+	c.mutex.Unlock()
+	c.Close()
+	if sio.IsConnected(c.sessionid) || c.Connected() {
+		t.Fatal("Did not expect a closed connection to be connected")
+	}
+	if sio.IsConnected("unknown") {
+		t.Fatal("Did not expect an unknown session to be connected")
+	}
+}
+
+func TestBroadcastExceptMany(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	var conns [4]*Conn
+	for i := range conns {
+		conns[i] = newTestConn(t, sio)
+	}
+
+	sio.BroadcastExceptMany([]*Conn{conns[0], nil, conns[2]}, "hello")
+	for i, c := range conns {
+		if expect := i%2 == 1; (c.queue.Len() == 1) != expect {
+			t.Fatalf("Expected the connection %d to be sent to: %v, but got %d messages", i, expect, c.queue.Len())
+		}
+	}
+}
+
+func TestBroadcastCount(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.QueueLength = 1
+	sio := NewSocketIO(&config)
+
+	if n := sio.BroadcastCount("hello"); n != 0 {
+		t.Fatalf("Expected no recipients, but got %d", n)
+	}
+
+	newTestConn(t, sio)
+	full := newTestConn(t, sio)
+	full.Send("filler")
+
+	if n := sio.BroadcastCount("hello"); n != 1 {
+		t.Fatalf("Expected 1 recipient, but got %d", n)
+	}
+}
+
+func TestBroadcastSync(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.QueueLength = 1
+	sio := NewSocketIO(&config)
+
+	c := newTestConn(t, sio)
+	if err := sio.BroadcastSync("hello"); err != nil {
+		t.Fatal("BroadcastSync:", err)
+	}
+	if n := c.queue.Len(); n != 1 {
+		t.Fatalf("Expected 1 message queued, but got %d", n)
+	}
+	if err := sio.BroadcastSync("hello"); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, but got: %v", err)
+	}
+}
+
+func TestBroadcastWhere(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	admin := newTestConn(t, sio)
+	admin.AddTag("admin")
+	user := newTestConn(t, sio)
+
+	n := sio.BroadcastWhere(func(c *Conn) bool {
+		for _, tag := range c.Tags() {
+			if tag == "admin" {
+				return true
+			}
+		}
+		return false
+	}, "hello")
+
+	if n != 1 || admin.queue.Len() != 1 || user.queue.Len() != 0 {
+		t.Fatalf("Expected the message to be queued for the admin only, but got %d recipients", n)
+	}
+}
+
+func TestBroadcastToTransport(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	websocket, polling := config.Transports[2], config.Transports[0]
+
+	ws := newTestConn(t, sio)
+	ws.socket.(*testSocket).t = websocket
+	poll := newTestConn(t, sio)
+	poll.socket.(*testSocket).t = polling
+	offline := newTestConn(t, sio)
+	offline.socket.(*testSocket).t = websocket
+	offline.online = false
+
+	sio.BroadcastToTransport(websocket.Resource(), "hello")
+
+	if n := ws.queue.Len(); n != 1 {
+		t.Fatalf("Expected 1 message queued for %s, but got %d", websocket.Resource(), n)
+	}
+	if n := poll.queue.Len(); n != 0 {
+		t.Fatalf("Expected no messages queued for %s, but got %d", polling.Resource(), n)
+	}
+	if n := offline.queue.Len(); n != 0 {
+		t.Fatalf("Expected no messages queued for an offline connection, but got %d", n)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	type mirroredMessage struct {
+		direction int
+		data      interface{}
+	}
+
+	mirrored := make(chan mirroredMessage, 3)
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.Mirror = func(direction int, c *Conn, data interface{}) {
+		mirrored <- mirroredMessage{direction, data}
+	}
+	sio := NewSocketIO(&config)
+
+	c := newTestConn(t, sio)
+	c.Send(heartbeat(1))
+	c.Send(ack("1"))
+	sio.Broadcast("hello")
+	c.receive([]byte(frame("hi", 1, false)))
+
+	m := <-mirrored
+	if m.direction != MirrorOut || m.data != "hello" {
+		t.Fatalf("Expected the outbound \"hello\", but got %v", m)
+	}
+	m = <-mirrored
+	if msg, ok := m.data.(Message); m.direction != MirrorIn || !ok || msg.Data() != "hi" {
+		t.Fatalf("Expected the inbound \"hi\", but got %v", m)
+	}
+}
+
+func TestMirrorDropped(t *testing.T) {
+	proceed := make(chan bool)
+	config := DefaultConfig
+	logged := new(bytes.Buffer)
+	config.Logger = log.New(logged, "", 0)
+	config.Mirror = func(direction int, c *Conn, data interface{}) {
+		<-proceed
+	}
+	sio := NewSocketIO(&config)
+
+	// the mirrorer blocks on the first message, the buffer takes the next ones
+	for i := 0; i < mirrorBufferSize+11; i++ {
+		sio.mirror(MirrorOut, nil, i)
+	}
+	if dropped := sio.Stats().MirrorDropped; dropped < 10 {
+		t.Fatalf("Expected at least 10 dropped messages, but got %d", dropped)
+	}
+	if lines := strings.Count(logged.String(), "\n"); lines != 1 {
+		t.Fatalf("Expected the drops to be logged once, but got %q", logged.String())
+	}
+	close(proceed)
+
+	if err := sio.Shutdown(1e9); err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+	dropped := sio.Stats().MirrorDropped
+	sio.mirror(MirrorOut, nil, "late")
+	if sio.Stats().MirrorDropped != dropped {
+		t.Fatal("Did not expect the messages to be mirrored after Shutdown")
+	}
+}
+
+func TestBroadcastSample(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.QueueLength = 1000
+	config.Rand = rand.New(rand.NewSource(1))
+	sio := NewSocketIO(&config)
+
+	var conns [100]*Conn
+	for i := range conns {
+		conns[i] = newTestConn(t, sio)
+	}
+	queued := func() (n int) {
+		for _, c := range conns {
+			n += c.queue.Len()
+		}
+		return
+	}
+
+	sio.BroadcastSample(0, "none")
+	if n := queued(); n != 0 {
+		t.Fatalf("Expected no messages with fraction 0, but got %d", n)
+	}
+
+	sio.BroadcastSample(1, "all")
+	if n := queued(); n != len(conns) {
+		t.Fatalf("Expected %d messages with fraction 1, but got %d", len(conns), n)
+	}
+
+	sio.BroadcastSample(0.5, "some")
+	if n := queued() - len(conns); n <= 25 || n >= 75 {
+		t.Fatalf("Expected about 50 messages with fraction 0.5, but got %d", n)
+	}
+}
+
+func TestStableBroadcastOrder(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.StableBroadcastOrder = true
+	sio := NewSocketIO(&config)
+
+	for i := 0; i < 10; i++ {
+		newTestConn(t, sio)
+	}
+
+	conns := sio.conns()
+	for i := 1; i < len(conns); i++ {
+		if conns[i-1].sessionid >= conns[i].sessionid {
+			t.Fatalf("Expected the connections to be sorted by session id, but got %v", conns)
+		}
+	}
+}
+
+func TestPollMode(t *testing.T) {
+	for _, mode := range []int{LongPoll, ShortPoll} {
+		config := DefaultConfig
+		config.Logger = NOPLogger
+		config.PollMode = mode
+		sio := NewSocketIO(&config)
+		mux := http.NewServeMux()
+		if err := sio.Mux("/socket.io/", mux); err != nil {
+			t.Fatal("Mux:", err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Listen:", err)
+		}
+		go http.Serve(listener, mux)
+
+		// poll returns the body of the response or "" if there was none in time
+		poll := func(path string) (string, bool) {
+			conn, err := net.Dial("tcp", "", listener.Addr().String())
+			if err != nil {
+				t.Fatal("Dial:", err)
+			}
+			defer conn.Close()
+
+			conn.(*net.TCPConn).SetReadTimeout(200e6)
+			if _, err = conn.Write([]byte("GET " + path + " HTTP/1.0\r\n\r\n")); err != nil {
+				t.Fatal("Write:", err)
+			}
+			response, _ := ioutil.ReadAll(conn)
+			if i := bytes.Index(response, []byte("\r\n\r\n")); i >= 0 {
+				return string(response[i+4:]), true
+			}
+			return "", false
+		}
+
+		handshake, ok := poll("/socket.io/xhr-polling")
+		msgs, err := config.Codec.NewDecoder(bytes.NewBufferString(handshake)).Decode()
+		if !ok || err != nil || len(msgs) != 1 || msgs[0].Type() != MessageHandshake {
+			t.Fatalf("Expected a handshake, but got %q: %v", handshake, err)
+		}
+
+		body, answered := poll("/socket.io/xhr-polling/" + msgs[0].Data())
+		switch mode {
+		case LongPoll:
+			if answered {
+				t.Fatalf("LongPoll: expected the poll to be held, but got %q", body)
+			}
+
+		case ShortPoll:
+			if !answered || body != "" {
+				t.Fatalf("ShortPoll: expected an empty response right away, but got %v %q", answered, body)
+			}
+		}
+
+		listener.Close()
+	}
+}
+
+func TestForceTransport(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.AllowForceTransport = true
+	sio := NewSocketIO(&config)
+	transport := sio.config.Transports[0]
+	resource := "/socket.io/" + transport.Resource()
+
+	w := newTestResponseWriter()
+	sio.handle(transport, w, newTestRequest("GET", resource+"?forceTransport=bogus"))
+	if w.status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d but got %d", http.StatusBadRequest, w.status)
+	}
+	if len(sio.sessions) != 0 {
+		t.Fatal("Did not expect a connection to be created")
+	}
+
+	if forced := sio.transport("websocket"); forced != sio.config.Transports[2] {
+		t.Fatalf("Expected the websocket transport, but got %v", forced)
+	}
+
+	// the request for the default transport is served by the forced one
+	sio.config.Transports = append(sio.config.Transports, testTransport("test"))
+	w = newTestResponseWriter()
+	sio.handle(transport, w, newTestRequest("GET", resource+"?forceTransport=test"))
+	if len(sio.sessions) != 1 {
+		t.Fatalf("Expected a connection to be created, but got status %d", w.status)
+	}
+	for _, c := range sio.sessions {
+		c.mutex.Lock()
+		forced := c.socket.Transport()
+		c.mutex.Unlock()
+
+		if forced != testTransport("test") {
+			t.Fatalf("Expected the connection to use the forced transport, but got %v", forced)
+		}
+	}
+}
+
+func TestValidateSessionID(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.ValidateSessionID = IsValidSessionID
+	sio := NewSocketIO(&config)
+	var received []string
+	sio.OnMessage(func(c *Conn, msg Message) {
+		received = append(received, msg.Data())
+	})
+
+	c := newTestConn(t, sio)
+	transport := sio.config.Transports[0]
+	post := func(sessionid string) *testResponseWriter {
+		data := "data=" + http.URLEscape(frame("hi", 1, false))
+		req := newTestRequest("POST", "/socket.io/"+transport.Resource()+"/"+sessionid)
+		req.Header["Content-Type"] = "application/x-www-form-urlencoded"
+		req.ContentLength = int64(len(data))
+		req.Body = &testBody{Reader: strings.NewReader(data)}
+
+		w := newTestResponseWriter()
+		sio.handle(transport, w, req)
+		return w
+	}
+
+	if w := post("not-a-session-id"); w.status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d but got %d", http.StatusBadRequest, w.status)
+	}
+	if w := post(string(c.sessionid)); w.status != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.status)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Expected a single message, but got %v", received)
+	}
+}
+
+func TestEvictOldest(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.MaxConnections = 3
+	config.CapacityPolicy = EvictOldest
+	sio := NewSocketIO(&config)
+
+	var conns [3]*Conn
+	for i := range conns {
+		conns[i] = newTestConn(t, sio)
+		time.Sleep(1e6)
+	}
+	conns[0].receive([]byte(frame("hi", 1, false)))
+
+	// the request fails to hijack, so no one is evicted
+	failing := sio.config.Transports[0]
+	w := newTestResponseWriter()
+	sio.handle(failing, w, newTestRequest("GET", "/socket.io/"+failing.Resource()))
+	if w.status == http.StatusServiceUnavailable {
+		t.Fatal("Expected the new connection to be admitted")
+	}
+	for _, c := range conns {
+		if !c.Connected() {
+			t.Fatal("Did not expect an eviction for a failed handshake")
+		}
+	}
+
+	// the new connection is established
+	w = newTestResponseWriter()
+	sio.handle(testTransport("test"), w, newTestRequest("GET", "/socket.io/test"))
+	if w.status == http.StatusServiceUnavailable {
+		t.Fatal("Expected the new connection to be admitted")
+	}
+
+	if conns[1].Connected() || sio.GetConn(conns[1].sessionid) != nil {
+		t.Fatal("Expected the least recently active connection to be evicted")
+	}
+	if !conns[0].Connected() || !conns[2].Connected() {
+		t.Fatal("Expected the other connections to stay connected")
+	}
+	if len(sio.sessions) != config.MaxConnections || sio.reserved != 0 || sio.evictions != 0 {
+		t.Fatalf("Expected %d sessions, but got %d", config.MaxConnections, len(sio.sessions))
+	}
+}
+
+func TestAdmissionRate(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.AdmissionRate = 2
+	sio := NewSocketIO(&config)
+	transport := config.Transports[0]
+	established := newTestConn(t, sio)
+
+	// the requests fail to hijack, but the admitted ones get past the rate limit
+	for i, refused := range []bool{false, false, true} {
+		w := newTestResponseWriter()
+		sio.handle(transport, w, newTestRequest("GET", "/socket.io/"+transport.Resource()))
+		if (w.status == http.StatusServiceUnavailable) != refused {
+			t.Fatalf("Expected the handshake %d to be refused: %v, but got status %d", i+1, refused, w.status)
+		}
+		if refused && w.headers["Retry-After"] == "" {
+			t.Fatal("Expected a Retry-After header")
+		}
+	}
+
+	w := newTestResponseWriter()
+	sio.handle(transport, w, newTestRequest("GET", "/socket.io/"+transport.Resource()+"/"+established.String()))
+	if w.status == http.StatusServiceUnavailable {
+		t.Fatal("Did not expect the requests of an established connection to be refused")
+	}
+
+	// a rate limited handshake does not evict anyone
+	sio.config.MaxConnections = 1
+	sio.config.CapacityPolicy = EvictOldest
+	w = newTestResponseWriter()
+	sio.handle(transport, w, newTestRequest("GET", "/socket.io/"+transport.Resource()))
+	if w.status != http.StatusServiceUnavailable || !established.Connected() {
+		t.Fatalf("Expected the handshake to be refused without an eviction, but got status %d", w.status)
+	}
+
+	// the handshakes refused at capacity don't spend the tokens
+	config.AdmissionRate = 1
+	config.MaxConnections = 1
+	sio = NewSocketIO(&config)
+	newTestConn(t, sio)
+	for i := 0; i < 3; i++ {
+		w = newTestResponseWriter()
+		sio.handle(transport, w, newTestRequest("GET", "/socket.io/"+transport.Resource()))
+		if w.status != http.StatusServiceUnavailable {
+			t.Fatalf("Expected the handshake to be refused at capacity, but got status %d", w.status)
+		}
+	}
+	sio.config.MaxConnections = 0
+	w = newTestResponseWriter()
+	sio.handle(transport, w, newTestRequest("GET", "/socket.io/"+transport.Resource()))
+	if w.status == http.StatusServiceUnavailable {
+		t.Fatal("Expected the handshake to be admitted once there is room")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	buf := new(bytes.Buffer)
+	sio.SetLogger(log.New(buf, "", 0))
+	sio.Log("hello,", "world")
+	if buf.String() != "hello, world\n" {
+		t.Fatalf("Expected the new logger to be used, but got %q", buf.String())
+	}
+
+	sio.SetLogger(nil)
+	sio.Log("dropped")
+	if buf.String() != "hello, world\n" {
+		t.Fatalf("Expected nothing to be logged, but got %q", buf.String())
+	}
+}
+
+// TestBody turns a reader into a request body.
+type testBody struct {
+	io.Reader
+}
+
+func (b *testBody) Close() os.Error {
+	return nil
+}
+
+func TestMaxPostBytes(t *testing.T) {
+	config := DefaultConfig
+	config.MaxPostBytes = 64
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	sio.OnMessage(func(c *Conn, msg Message) {
+		t.Fatalf("Did not expect a message, but got %q", msg.Data())
+	})
+
+	c, err := newConn(sio)
+	if err != nil {
+		t.Fatal("newConn:", err)
+	}
+	sio.onConnect(c)
+
+	transport := sio.config.Transports[0]
+	data := "data=" + http.URLEscape(frame(strings.Repeat("x", 128), 1, false))
+	req := newTestRequest("POST", "/socket.io/"+transport.Resource()+"/"+string(c.sessionid))
+	req.Header["Content-Type"] = "application/x-www-form-urlencoded"
+	req.ContentLength = int64(len(data))
+	req.Body = &testBody{Reader: strings.NewReader(data)}
+
+	w := newTestResponseWriter()
+	sio.handle(transport, w, req)
+	if w.status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status %d but got %d", http.StatusRequestEntityTooLarge, w.status)
+	}
+
+	// a chunked body of an unknown length
+	req = newTestRequest("POST", "/socket.io/"+transport.Resource()+"/"+string(c.sessionid))
+	req.Header["Content-Type"] = "application/x-www-form-urlencoded"
+	req.ContentLength = -1
+	req.Body = &testBody{Reader: strings.NewReader(data)}
+
+	w = newTestResponseWriter()
+	sio.handle(transport, w, req)
+	if w.status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status %d for a chunked body but got %d", http.StatusRequestEntityTooLarge, w.status)
+	}
+}
+
+func TestServeFlashPolicy(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.Origins = []string{"localhost:8080", "*:*"}
+	sio := NewSocketIO(&config)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	defer listener.Close()
+	go sio.ServeFlashPolicy(listener)
+
+	conn, err := net.Dial("tcp", "", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("<policy-file-request/>\x00")); err != nil {
+		t.Fatal("Write:", err)
+	}
+	policy, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal("ReadAll:", err)
+	}
+	if !bytes.Equal(policy, sio.generatePolicyFile()) {
+		t.Fatalf("Expected the policy file but got %q", policy)
+	}
+}
+
+// TestListener is a net.Listener that fails to accept with the given errors.
+type testListener struct {
+	errs []os.Error
+}
+
+func (l *testListener) Accept() (net.Conn, os.Error) {
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func (l *testListener) Close() os.Error {
+	return nil
+}
+
+func (l *testListener) Addr() net.Addr {
+	return nil
+}
+
+// TemporaryError is a net.Error that is temporary.
+type temporaryError string
+
+func (e temporaryError) String() string {
+	return string(e)
+}
+
+func (e temporaryError) Timeout() bool {
+	return false
+}
+
+func (e temporaryError) Temporary() bool {
+	return true
+}
+
+func TestServeFlashPolicyAcceptErrors(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	closed := os.NewError("use of closed network connection")
+	listener := &testListener{[]os.Error{temporaryError("too many open files"), closed}}
+	if err := sio.ServeFlashPolicy(listener); err != closed {
+		t.Fatalf("Expected to return on the closed listener only, but got: %v", err)
+	}
+}
+
+func TestVerifyOrigin(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.Origins = []string{"example.com:443", "localhost:80"}
+	sio := NewSocketIO(&config)
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://example.com", true},
+		{"wss://example.com", true},
+		{"HTTPS://example.com", true},
+		{"https://example.com:443", true},
+		{"http://example.com", false},
+		{"http://localhost", true},
+		{"ws://localhost", true},
+		{"wss://localhost", false},
+	}
+
+	for _, test := range tests {
+		if _, ok := sio.verifyOrigin(test.origin); ok != test.ok {
+			t.Errorf("verifyOrigin(%q): expected %v but got %v", test.origin, test.ok, ok)
+		}
+	}
+}
+
+func TestFlashPolicyWorkers(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.FlashPolicyWorkers = 1
+	sio := NewSocketIO(&config)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	defer listener.Close()
+	go sio.ServeFlashPolicy(listener)
+
+	// the first connection occupies the only worker until it sends its request
+	busy, err := net.Dial("tcp", "", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer busy.Close()
+	time.Sleep(50e6)
+
+	excess, err := net.Dial("tcp", "", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer excess.Close()
+	if policy, _ := ioutil.ReadAll(excess); len(policy) != 0 {
+		t.Fatalf("Expected the excess connection to be closed, but got %q", policy)
+	}
+
+	if _, err = busy.Write([]byte("<policy-file-request/>\x00")); err != nil {
+		t.Fatal("Write:", err)
+	}
+	policy, err := ioutil.ReadAll(busy)
+	if err != nil {
+		t.Fatal("ReadAll:", err)
+	}
+	if !bytes.Equal(policy, sio.generatePolicyFile()) {
+		t.Fatalf("Expected the policy file but got %q", policy)
+	}
+
+	// an idle connection gives up the worker after the read timeout
+	defer func(timeout int64) { flashPolicyReadTimeout = timeout }(flashPolicyReadTimeout)
+	flashPolicyReadTimeout = 50e6
+
+	idle, err := net.Dial("tcp", "", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer idle.Close()
+	if policy, _ := ioutil.ReadAll(idle); len(policy) != 0 {
+		t.Fatalf("Expected the idle connection to be closed, but got %q", policy)
+	}
+
+	next, err := net.Dial("tcp", "", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer next.Close()
+	if _, err = next.Write([]byte("<policy-file-request/>\x00")); err != nil {
+		t.Fatal("Write:", err)
+	}
+	if policy, _ = ioutil.ReadAll(next); !bytes.Equal(policy, sio.generatePolicyFile()) {
+		t.Fatalf("Expected the policy file after the idle connection timed out, but got %q", policy)
+	}
+}
+
+func TestCustomVerifyOrigin(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.Origins = []string{"example.com:*"}
+	config.VerifyOrigin = func(origin string) bool {
+		return origin == "http://trusted.com"
+	}
+	sio := NewSocketIO(&config)
+	transport := config.Transports[0]
+
+	for origin, status := range map[string]int{
+		"http://trusted.com": http.StatusOK,
+		"http://example.com": http.StatusUnauthorized,
+	} {
+		req := newTestRequest("OPTIONS", "/socket.io/"+transport.Resource())
+		req.Header["Origin"] = origin
+		w := newTestResponseWriter()
+		sio.handle(transport, w, req)
+		if w.status != status {
+			t.Fatalf("Expected the origin %s to get %d, but got %d", origin, status, w.status)
+		}
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+	var refused []*ProtocolVersionError
+	sio.OnVersionRefused(func(err *ProtocolVersionError) {
+		refused = append(refused, err)
+	})
+	mux := http.NewServeMux()
+	if err := sio.Mux("/socket.io/", mux); err != nil {
+		t.Fatal("Mux:", err)
+	}
+
+	w := newTestResponseWriter()
+	mux.ServeHTTP(w, newTestRequest("GET", "/socket.io/1/?t=1300000000000"))
+	if w.status != http.StatusBadRequest || !strings.Contains(w.body.String(), "unsupported protocol version 1") {
+		t.Fatalf("Expected the versioned request to be refused, but got %d: %q", w.status, w.body.String())
+	}
+	if len(refused) != 1 {
+		t.Fatalf("Expected OnVersionRefused to be invoked once, but got %v", refused)
+	}
+	if refused[0].Version != "1" {
+		t.Fatalf("Expected a ProtocolVersionError for the version 1, but got %v", refused[0])
+	}
+
+	// the unversioned protocol is served as usual
+	w = newTestResponseWriter()
+	mux.ServeHTTP(w, newTestRequest("OPTIONS", "/socket.io/xhr-polling"))
+	if w.status != http.StatusOK || len(refused) != 1 {
+		t.Fatalf("Expected the unversioned request to be served, but got %d", w.status)
+	}
+}
+
+func TestOnUnknownSession(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	transport := config.Transports[0]
+
+	sio := NewSocketIO(&config)
+	c := newTestConn(t, sio)
+	sio.onDisconnect(c)
+	path := "/socket.io/" + transport.Resource() + "/" + c.String()
+
+	w := newTestResponseWriter()
+	sio.handle(transport, w, newTestRequest("GET", path))
+	if w.status != http.StatusBadRequest {
+		t.Fatalf("Expected a reaped session to get %d by default, but got %d", http.StatusBadRequest, w.status)
+	}
+
+	config.OnUnknownSession = func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}
+	sio = NewSocketIO(&config)
+	w = newTestResponseWriter()
+	sio.handle(transport, w, newTestRequest("GET", path))
+	if w.status != http.StatusGone {
+		t.Fatalf("Expected the custom response %d, but got %d", http.StatusGone, w.status)
+	}
+}
+
+// TestTCPConn records the TCP options applied to it.
+type testTCPConn struct {
+	net.Conn
+	noDelay, keepAlive []bool
+}
+
+func (c *testTCPConn) SetNoDelay(noDelay bool) os.Error {
+	c.noDelay = append(c.noDelay, noDelay)
+	return nil
+}
+
+func (c *testTCPConn) SetKeepAlive(keepAlive bool) os.Error {
+	c.keepAlive = append(c.keepAlive, keepAlive)
+	return nil
+}
+
+type hijackingResponseWriter struct {
+	*testResponseWriter
+	conn *testTCPConn
+}
+
+func (w *hijackingResponseWriter) Hijack() (io.ReadWriteCloser, *bufio.ReadWriter, os.Error) {
+	return w.conn, nil, nil
+}
+
+func TestTCPOptions(t *testing.T) {
+	tests := []struct {
+		noDelay   bool
+		keepAlive bool
+		expected  string
+	}{
+		{true, false, "[true] []"},
+		{false, false, "[false] []"},
+		{true, true, "[true] [true]"},
+	}
+
+	transports := []Transport{
+		NewWebsocketTransport(0, 0),
+		NewFlashsocketTransport(0, 0),
+		NewXHRPollingTransport(0, 0),
+	}
+
+	for _, test := range tests {
+		config := DefaultConfig
+		config.Logger = NOPLogger
+		config.TCPNoDelay = test.noDelay
+		config.TCPKeepAlive = test.keepAlive
+		sio := NewSocketIO(&config)
+
+		for _, transport := range transports {
+			w := &hijackingResponseWriter{newTestResponseWriter(), &testTCPConn{}}
+			rwc, _, err := sio.tcpOptions(transport, w).Hijack()
+			if err != nil {
+				t.Fatalf("%s: Hijack: %s", transport.Resource(), err)
+			}
+			if rwc != w.conn {
+				t.Fatalf("%s: Expected the hijacked conn to be passed through", transport.Resource())
+			}
+
+			expected := test.expected
+			if _, ok := transport.(*xhrPollingTransport); ok {
+				expected = "[] []"
+			}
+			if got := fmt.Sprint(w.conn.noDelay, " ", w.conn.keepAlive); got != expected {
+				t.Errorf("%s: TCPNoDelay=%v TCPKeepAlive=%v: expected %s but got %s",
+					transport.Resource(), test.noDelay, test.keepAlive, expected, got)
+			}
+		}
+	}
+}
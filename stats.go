@@ -0,0 +1,194 @@
+package socketio
+
+import (
+	"http"
+	"json"
+	"time"
+)
+
+// Stats is a snapshot of the server's state and counters.
+type Stats struct {
+	Connections     int            // Number of established connections.
+	Transports      map[string]int // Number of live sockets per transport resource.
+	PacketsSent     int64          // Number of messages written to the sockets.
+	PacketsReceived int64          // Number of messages decoded from the sockets.
+	MirrorDropped   int64          // Number of messages not mirrored, see Config.Mirror.
+	Uptime          int64          // Time in ns since the server was created.
+}
+
+// Stats returns a snapshot of the server's state and counters.
+func (sio *SocketIO) Stats() (stats Stats) {
+	conns := sio.conns()
+	stats.Connections = len(conns)
+	stats.Transports = make(map[string]int)
+	for _, c := range conns {
+		if t := c.transport(); t != nil {
+			stats.Transports[t.Resource()]++
+		}
+	}
+
+	sio.counters.Lock()
+	stats.PacketsSent = sio.counters.sent
+	stats.PacketsReceived = sio.counters.received
+	stats.MirrorDropped = sio.counters.mirrorDropped
+	sio.counters.Unlock()
+
+	stats.Uptime = time.Nanoseconds() - sio.started
+	return
+}
+
+// CountChange signals the countWatcher that the number of established connections
+// has changed, if config.OnConnectionCountChange is set.
+func (sio *SocketIO) countChange() {
+	if sio.countChanged != nil {
+		_ = sio.countChanged <- 1
+	}
+}
+
+// CountWatcher passes the number of established connections to the user's
+// config.OnConnectionCountChange whenever it has changed, but at most once per
+// config.ConnectionCountInterval.
+func (sio *SocketIO) countWatcher() {
+	last := 0
+	for _ = range sio.countChanged {
+		sio.sessionsLock.RLock()
+		count := len(sio.sessions)
+		sio.sessionsLock.RUnlock()
+
+		if count != last {
+			sio.config.OnConnectionCountChange(count)
+			last = count
+		}
+		time.Sleep(sio.config.ConnectionCountInterval)
+	}
+}
+
+// ConnInfo is a snapshot of a connection's state and counters.
+type ConnInfo struct {
+	SessionID       SessionID
+	Transport       string   // Resource of the transport of the live socket or "".
+	Connected       bool     // Does the connection have a live socket.
+	Age             int64    // Time in ns since the connection was created.
+	QueueLength     int      // Number of messages waiting for a delivery.
+	Tags            []string // Tags of the connection.
+	LastActivity    int64    // Time in ns of the last message sent or received or 0.
+	PacketsSent     int64    // Number of messages written to the sockets.
+	PacketsReceived int64    // Number of messages decoded from the sockets.
+}
+
+// Debug returns a snapshot of the connection's state and counters for diagnostic
+// purposes. It is safe to be called at any time, also from within the callbacks.
+func (c *Conn) Debug() (info ConnInfo) {
+	info.SessionID = c.sessionid
+	if t := c.transport(); t != nil {
+		info.Transport = t.Resource()
+	}
+	info.Connected = c.Connected()
+	info.Age = time.Nanoseconds() - c.created
+	info.QueueLength = c.queue.Len()
+	info.Tags = c.Tags()
+
+	c.counters.Lock()
+	info.LastActivity = c.counters.lastActivity
+	info.PacketsSent = c.counters.sent
+	info.PacketsReceived = c.counters.received
+	c.counters.Unlock()
+
+	return
+}
+
+// ProbeResult is the outcome of SocketIO.Probe.
+type ProbeResult struct {
+	Healthy  int // Number of connections with a live socket that are being flushed.
+	Stalled  int // Number of connections with a live socket and a stalled send queue.
+	Detached int // Number of connections waiting for their client to reconnect.
+}
+
+// Probe checks the health of the established connections. A connection with a live
+// socket is stalled if its send queue has refused messages for being full and no
+// messages have been flushed for longer than config.StallTimeout, i.e. the client is
+// not keeping up. The connections without a live socket are reported as detached.
+func (sio *SocketIO) Probe() (result ProbeResult) {
+	for _, c := range sio.conns() {
+		switch {
+		case !c.Connected():
+			result.Detached++
+
+		case c.queue.stalled(sio.config.StallTimeout):
+			result.Stalled++
+
+		default:
+			result.Healthy++
+		}
+	}
+	return
+}
+
+// StatsHandler returns a http handler that serves the Stats snapshot as JSON. If
+// config.StatsAuth is set, the requests it does not authorize are answered with
+// 401 Unauthorized.
+func (sio *SocketIO) StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if sio.config.StatsAuth != nil && !sio.config.StatsAuth(req) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		data, err := json.Marshal(sio.Stats())
+		if err != nil {
+			sio.Log("sio/stats: marshal:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.SetHeader("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+// LastActivity returns the time of the last message sent to or received from c, or
+// the creation time of c if there have been no messages yet.
+func (c *Conn) lastActivity() int64 {
+	c.counters.Lock()
+	defer c.counters.Unlock()
+
+	if c.counters.lastActivity == 0 {
+		return c.created
+	}
+	return c.counters.lastActivity
+}
+
+// CountSent adds n to the number of sent packets.
+func (sio *SocketIO) countSent(n int) {
+	sio.counters.Lock()
+	sio.counters.sent += int64(n)
+	sio.counters.Unlock()
+}
+
+// CountReceived adds n to the number of received packets.
+func (sio *SocketIO) countReceived(n int) {
+	sio.counters.Lock()
+	sio.counters.received += int64(n)
+	sio.counters.Unlock()
+}
+
+// CountSent adds n to the number of packets sent to c and to the server's total.
+func (c *Conn) countSent(n int) {
+	c.counters.Lock()
+	c.counters.sent += int64(n)
+	c.counters.lastActivity = time.Nanoseconds()
+	c.counters.Unlock()
+
+	c.server().countSent(n)
+}
+
+// CountReceived adds n to the number of packets received from c and to the
+// server's total.
+func (c *Conn) countReceived(n int) {
+	c.counters.Lock()
+	c.counters.received += int64(n)
+	c.counters.lastActivity = time.Nanoseconds()
+	c.counters.Unlock()
+
+	c.server().countReceived(n)
+}
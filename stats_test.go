@@ -0,0 +1,131 @@
+package socketio
+
+import (
+	"http"
+	"json"
+	"testing"
+	"time"
+)
+
+func TestStatsHandler(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.StatsAuth = func(req *http.Request) bool {
+		return req.FormValue("secret") == "s3cret"
+	}
+	sio := NewSocketIO(&config)
+
+	for i := 0; i < 3; i++ {
+		c, err := newConn(sio)
+		if err != nil {
+			t.Fatal("newConn:", err)
+		}
+		sio.onConnect(c)
+	}
+
+	w := newTestResponseWriter()
+	sio.StatsHandler()(w, newTestRequest("GET", "/stats"))
+	if w.status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d but got %d", http.StatusUnauthorized, w.status)
+	}
+
+	w = newTestResponseWriter()
+	sio.StatsHandler()(w, newTestRequest("GET", "/stats?secret=s3cret"))
+	if w.status != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.status)
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(w.body.Bytes(), &stats); err != nil {
+		t.Fatalf("Unmarshal %q: %s", w.body.String(), err)
+	}
+	if stats.Connections != 3 {
+		t.Fatalf("Expected 3 connections but got %d", stats.Connections)
+	}
+	if stats.Uptime <= 0 {
+		t.Fatalf("Expected a positive uptime but got %d", stats.Uptime)
+	}
+}
+
+func TestConnDebug(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	c := newTestConn(t, sio)
+	c.AddTag("tenant:acme")
+	c.Send("hello")
+	c.Send("world")
+	c.receive([]byte(frame("hi", 1, false)))
+
+	info := c.Debug()
+	if info.SessionID != c.sessionid || !info.Connected {
+		t.Fatalf("Expected a connected session %s, but got %+v", c.sessionid, info)
+	}
+	if info.QueueLength != 2 {
+		t.Fatalf("Expected 2 queued messages but got %d", info.QueueLength)
+	}
+	if len(info.Tags) != 1 || info.Tags[0] != "tenant:acme" {
+		t.Fatalf("Expected the tag tenant:acme but got %v", info.Tags)
+	}
+	if info.PacketsReceived != 1 || info.PacketsSent != 0 {
+		t.Fatalf("Expected 1 received and 0 sent packets, but got %d and %d", info.PacketsReceived, info.PacketsSent)
+	}
+	if info.LastActivity <= 0 || info.Age < 0 {
+		t.Fatalf("Expected the last activity and the age to be set, but got %+v", info)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.QueueLength = 2
+	config.StallTimeout = 10e6
+	sio := NewSocketIO(&config)
+
+	newTestConn(t, sio)
+	detached := newTestConn(t, sio)
+	detached.online = false
+	stalled := newTestConn(t, sio)
+	for i := 0; i <= config.QueueLength; i++ {
+		stalled.Send(i)
+	}
+
+	if result := sio.Probe(); result.Healthy != 2 || result.Stalled != 0 || result.Detached != 1 {
+		t.Fatalf("Expected 2 healthy and 1 detached connection, but got %+v", result)
+	}
+
+	time.Sleep(2 * config.StallTimeout)
+	if result := sio.Probe(); result.Healthy != 1 || result.Stalled != 1 || result.Detached != 1 {
+		t.Fatalf("Expected 1 healthy, 1 stalled and 1 detached connection, but got %+v", result)
+	}
+}
+
+func TestOnConnectionCountChange(t *testing.T) {
+	counts := make(chan int, 10)
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.ConnectionCountInterval = 50e6
+	config.OnConnectionCountChange = func(count int) {
+		counts <- count
+	}
+	sio := NewSocketIO(&config)
+
+	for i := 0; i < 3; i++ {
+		newTestConn(t, sio)
+	}
+
+	// the burst is reported by at most two calls, the latter with the final count
+	var reported []int
+	for len(reported) == 0 || reported[len(reported)-1] != 3 {
+		select {
+		case count := <-counts:
+			reported = append(reported, count)
+		case <-time.After(1e9):
+			t.Fatalf("Expected the count 3 to be reported, but got %v", reported)
+		}
+	}
+	if len(reported) > 2 {
+		t.Fatalf("Expected the burst to be debounced, but got %v", reported)
+	}
+}
@@ -0,0 +1,97 @@
+package socketio
+
+import (
+	"os"
+)
+
+// ErrTooManyTags is used when a connection already has config.MaxTagsPerConn tags.
+var ErrTooManyTags = os.NewError("too many tags")
+
+// AddTag tags the connection with tag. Tags are arbitrary strings, e.g. "tenant:acme"
+// or "role:admin", that can be used to query and manage the connections in bulk.
+// The tags are dropped when the connection is disconnected and tagging a connection
+// that is not established has no effect. If the connection already has
+// config.MaxTagsPerConn tags, the tag is not added and ErrTooManyTags is returned.
+func (c *Conn) AddTag(tag string) os.Error {
+	sio := c.lockSessions(true)
+	defer sio.sessionsLock.Unlock()
+
+	if sio.sessions[c.sessionid] != c || c.tags[tag] {
+		return nil
+	}
+
+	if max := sio.config.MaxTagsPerConn; max > 0 && len(c.tags) >= max {
+		return ErrTooManyTags
+	}
+
+	sio.tagConn(c, tag)
+	return nil
+}
+
+// Tags returns the tags of the connection.
+func (c *Conn) Tags() []string {
+	sio := c.lockSessions(false)
+	defer sio.sessionsLock.RUnlock()
+
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// CountByTag returns the number of connections tagged with tag.
+func (sio *SocketIO) CountByTag(tag string) int {
+	sio.sessionsLock.RLock()
+	defer sio.sessionsLock.RUnlock()
+
+	return len(sio.tags[tag])
+}
+
+// CloseByTag closes all the connections tagged with tag and returns the number
+// of connections closed.
+func (sio *SocketIO) CloseByTag(tag string) (n int) {
+	sio.sessionsLock.RLock()
+	conns := make([]*Conn, 0, len(sio.tags[tag]))
+	for _, c := range sio.tags[tag] {
+		conns = append(conns, c)
+	}
+	sio.sessionsLock.RUnlock()
+
+	for _, c := range conns {
+		if c.Close() == nil {
+			n++
+		}
+	}
+	return
+}
+
+// TagConn tags c with tag and adds it to the tag index. It must be called with
+// sio.sessionsLock held.
+func (sio *SocketIO) tagConn(c *Conn, tag string) {
+	if c.tags == nil {
+		c.tags = make(map[string]bool)
+	}
+	c.tags[tag] = true
+
+	conns, ok := sio.tags[tag]
+	if !ok {
+		conns = make(map[SessionID]*Conn)
+		sio.tags[tag] = conns
+	}
+	conns[c.sessionid] = c
+}
+
+// UntagConn removes c from the tag index. It must be called with
+// sio.sessionsLock held.
+func (sio *SocketIO) untagConn(c *Conn) {
+	for tag := range c.tags {
+		if conns, ok := sio.tags[tag]; ok {
+			conns[c.sessionid] = nil, false
+			if len(conns) == 0 {
+				sio.tags[tag] = nil, false
+			}
+		}
+	}
+	c.tags = nil
+}
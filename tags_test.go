@@ -0,0 +1,77 @@
+package socketio
+
+import (
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	sio := NewSocketIO(&config)
+
+	var conns [3]*Conn
+	for i := range conns {
+		c, err := newConn(sio)
+		if err != nil {
+			t.Fatal("newConn:", err)
+		}
+		sio.onConnect(c)
+		conns[i] = c
+	}
+
+	conns[0].AddTag("role:admin")
+	conns[0].AddTag("tenant:acme")
+	conns[1].AddTag("tenant:acme")
+	conns[1].AddTag("tenant:acme")
+
+	if n := sio.CountByTag("tenant:acme"); n != 2 {
+		t.Fatalf("Expected 2 connections tagged with tenant:acme, but got %d", n)
+	}
+	if n := sio.CountByTag("role:admin"); n != 1 {
+		t.Fatalf("Expected 1 connection tagged with role:admin, but got %d", n)
+	}
+	if tags := conns[0].Tags(); len(tags) != 2 {
+		t.Fatalf("Expected 2 tags but got %v", tags)
+	}
+	if tags := conns[2].Tags(); tags == nil || len(tags) != 0 {
+		t.Fatalf("Expected no tags but got %v", tags)
+	}
+
+	sio.onDisconnect(conns[0])
+	if n := sio.CountByTag("tenant:acme"); n != 1 {
+		t.Fatalf("Expected 1 connection tagged with tenant:acme after disconnect, but got %d", n)
+	}
+	if n := sio.CountByTag("role:admin"); n != 0 {
+		t.Fatalf("Expected no connections tagged with role:admin after disconnect, but got %d", n)
+	}
+
+	conns[0].AddTag("role:admin")
+	if n := sio.CountByTag("role:admin"); n != 0 {
+		t.Fatal("Expected tagging a disconnected connection to have no effect")
+	}
+}
+
+func TestMaxTagsPerConn(t *testing.T) {
+	config := DefaultConfig
+	config.Logger = NOPLogger
+	config.MaxTagsPerConn = 2
+	sio := NewSocketIO(&config)
+
+	c, err := newConn(sio)
+	if err != nil {
+		t.Fatal("newConn:", err)
+	}
+	sio.onConnect(c)
+
+	for _, tag := range []string{"a", "b", "b"} {
+		if err := c.AddTag(tag); err != nil {
+			t.Fatalf("AddTag %q: %s", tag, err)
+		}
+	}
+	if err := c.AddTag("c"); err != ErrTooManyTags {
+		t.Fatalf("Expected ErrTooManyTags, but got %v", err)
+	}
+	if n := sio.CountByTag("c"); n != 0 {
+		t.Fatalf("Expected the tag not to be added, but %d connections have it", n)
+	}
+}
@@ -34,10 +34,20 @@ var DefaultTransports = []Transport{
 //
 // Resource returns the resource name of the transport, e.g. "websocket".
 // NewSocket creates a new socket that embeds the corresponding transport
-// mechanisms.
+// mechanisms, configured by the Config of the server it is created for.
 type Transport interface {
 	Resource() string
-	newSocket() socket
+	newSocket(config *Config) socket
+}
+
+// IsPolling reports whether t is a polling transport, i.e. one that delivers a
+// single response per request.
+func isPolling(t Transport) bool {
+	switch t.(type) {
+	case *xhrPollingTransport, *jsonpPollingTransport:
+		return true
+	}
+	return false
 }
 
 // Socket is the interface that wraps the basic Read, Write, Close and String
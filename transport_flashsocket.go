@@ -21,8 +21,8 @@ func (t *flashsocketTransport) Resource() string {
 }
 
 // Creates a new socket that can be used with a connection.
-func (t *flashsocketTransport) newSocket() socket {
-	return &flashsocketSocket{t: t, s: t.wsTransport.newSocket()}
+func (t *flashsocketTransport) newSocket(config *Config) socket {
+	return &flashsocketSocket{t: t, s: t.wsTransport.newSocket(config)}
 }
 
 // flashsocketTransport implements the transport interface for flashsockets
@@ -11,7 +11,18 @@ import (
 	"fmt"
 )
 
-var htmlfileHeader = "<html><body>" + strings.Repeat(" ", 244)
+// The default size of the prelude of the htmlfile transport, see Config.HTMLFilePreludeSize.
+const htmlfilePreludeSize = 256
+
+// HTMLFilePrelude returns the html that starts the htmlfile stream, padded to size
+// bytes so the browsers and the proxies start rendering it.
+func htmlfilePrelude(size int) string {
+	const start = "<html><body>"
+	if size < len(start) {
+		size = htmlfilePreludeSize
+	}
+	return start + strings.Repeat(" ", size-len(start))
+}
 
 // The xhr-multipart transport.
 type htmlfileTransport struct {
@@ -30,8 +41,8 @@ func (t *htmlfileTransport) Resource() string {
 }
 
 // Creates a new socket that can be used with a connection.
-func (t *htmlfileTransport) newSocket() socket {
-	return &htmlfileSocket{t: t}
+func (t *htmlfileTransport) newSocket(config *Config) socket {
+	return &htmlfileSocket{t: t, prelude: config.HTMLFilePreludeSize}
 }
 
 // Implements the socket interface for xhr-multipart transports.
@@ -39,6 +50,7 @@ type htmlfileSocket struct {
 	t         *htmlfileTransport
 	rwc       io.ReadWriteCloser
 	connected bool
+	prelude   int // The size of the prelude, see Config.HTMLFilePreludeSize.
 }
 
 // String returns a verbose representation of the socket.
@@ -73,7 +85,8 @@ func (s *htmlfileSocket) accept(w http.ResponseWriter, req *http.Request, procee
 			rwc.Close()
 			return
 		}
-		if _, err = fmt.Fprintf(rwc, "%x\r\n%s\r\n", len(htmlfileHeader), htmlfileHeader); err != nil {
+		prelude := htmlfilePrelude(s.prelude)
+		if _, err = fmt.Fprintf(rwc, "%x\r\n%s\r\n", len(prelude), prelude); err != nil {
 			rwc.Close()
 			return
 		}
@@ -0,0 +1,25 @@
+package socketio
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTMLFilePrelude(t *testing.T) {
+	for _, size := range []int{256, 1024, 4096} {
+		prelude := htmlfilePrelude(size)
+		if len(prelude) != size || !strings.HasPrefix(prelude, "<html><body>") {
+			t.Fatalf("Expected a prelude of %d bytes, but got %d bytes: %q", size, len(prelude), prelude)
+		}
+	}
+
+	if prelude := htmlfilePrelude(0); len(prelude) != htmlfilePreludeSize {
+		t.Fatalf("Expected the default prelude of %d bytes, but got %d bytes", htmlfilePreludeSize, len(prelude))
+	}
+
+	config := DefaultConfig
+	config.HTMLFilePreludeSize = 1024
+	if s := NewHTMLFileTransport(0, 0).newSocket(&config).(*htmlfileSocket); s.prelude != 1024 {
+		t.Fatalf("Expected the socket to use the prelude of %d bytes, but got %d bytes", 1024, s.prelude)
+	}
+}
@@ -27,7 +27,7 @@ func (t *jsonpPollingTransport) Resource() string {
 }
 
 // Creates a new socket which can be used be a connection.
-func (t *jsonpPollingTransport) newSocket() (s socket) {
+func (t *jsonpPollingTransport) newSocket(config *Config) (s socket) {
 	return &jsonpPollingSocket{t: t}
 }
 
@@ -1,8 +1,11 @@
 package socketio
 
 import (
+	"bufio"
 	"http"
+	"io"
 	"os"
+	"time"
 	"websocket"
 )
 
@@ -25,16 +28,22 @@ func (t *websocketTransport) Resource() string {
 }
 
 // Creates a new socket that can be used with a connection.
-func (t *websocketTransport) newSocket() socket {
-	return &websocketSocket{t: t}
+func (t *websocketTransport) newSocket(config *Config) socket {
+	return &websocketSocket{t: t, closeTimeout: config.CloseHandshakeTimeout}
 }
 
 // websocketTransport implements the transport interface for websockets
 type websocketSocket struct {
-	t         *websocketTransport // the transport configuration
-	ws        *websocket.Conn     // the websocket connection
-	connected bool                // used internally to represent the connection state
-	close     chan byte
+	t            *websocketTransport // the transport configuration
+	ws           *websocket.Conn     // the websocket connection
+	connected    bool                // used internally to represent the connection state
+	close        chan byte
+	rwc          io.ReadWriteCloser // the hijacked connection underlying ws
+	buf          *bufio.ReadWriter  // the buffers of rwc shared with ws
+	draft76      bool               // does the client speak draft-76, which has a closing handshake
+	broken       bool               // has a read failed, i.e. the client is gone
+	closeTimeout int64              // see Config.CloseHandshakeTimeout
+	closing      chan byte          // signaled once the closing frame of the client has been read
 }
 
 // Transport returns the transport the socket is based on.
@@ -72,7 +81,9 @@ func (s *websocketSocket) accept(w http.ResponseWriter, req *http.Request, proce
 	}
 
 	err = errWebsocketHandshake
+	w = &hijackRecorder{w, s}
 	if _, ok := req.Header["Sec-Websocket-Key1"]; ok {
+		s.draft76 = true
 		websocket.Handler(f).ServeHTTP(w, req)
 	} else {
 		websocket.Draft75Handler(f).ServeHTTP(w, req)
@@ -81,12 +92,55 @@ func (s *websocketSocket) accept(w http.ResponseWriter, req *http.Request, proce
 	return
 }
 
-func (s *websocketSocket) Read(p []byte) (int, os.Error) {
+// Read reads the next message of the client. Once the socket has sent its closing
+// frame, it reads up to the closing frame of the client instead and reports the end
+// of the stream.
+func (s *websocketSocket) Read(p []byte) (n int, err os.Error) {
+	if s.closing != nil {
+		if err = s.awaitClose(); err == nil {
+			err = os.EOF
+		}
+		_ = s.closing <- 1
+		return 0, err
+	}
+
 	if !s.connected {
 		return 0, ErrNotConnected
 	}
 
-	return s.ws.Read(p)
+	if n, err = s.ws.Read(p); err != nil {
+		s.broken = true
+	}
+	return
+}
+
+// AwaitClose reads and discards the frames of the client up to its closing frame,
+// i.e. 0xFF 0x00. It returns an error if the stream ends before that.
+func (s *websocketSocket) awaitClose() os.Error {
+	for {
+		b, err := s.buf.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch b {
+		case 0x00:
+			// a text frame, which ends with 0xFF
+			if _, err = s.buf.ReadBytes(0xFF); err != nil {
+				return err
+			}
+
+		case 0xFF:
+			if b, err = s.buf.ReadByte(); err != nil {
+				return err
+			}
+			if b == 0x00 {
+				return nil
+			}
+		}
+	}
+
+	return nil
 }
 
 func (s *websocketSocket) Write(p []byte) (int, os.Error) {
@@ -97,12 +151,77 @@ func (s *websocketSocket) Write(p []byte) (int, os.Error) {
 	return s.ws.Write(p)
 }
 
+// Close closes the socket. If the client speaks draft-76, the socket first sends
+// its closing frame and waits up to config.CloseHandshakeTimeout for the closing
+// frame of the client, which Read picks up, before the connection is closed.
 func (s *websocketSocket) Close() os.Error {
 	if !s.connected {
 		return ErrNotConnected
 	}
 
 	s.connected = false
-	go func() { _ = s.close <- 1 }()
-	return s.ws.Close()
+	if !s.draft76 || s.broken || s.closeTimeout <= 0 || s.buf == nil {
+		go func() { _ = s.close <- 1 }()
+		return s.rwc.Close()
+	}
+
+	s.closing = make(chan byte, 1)
+	if _, err := s.buf.Write([]byte{0xFF, 0x00}); err != nil || s.buf.Flush() != nil {
+		go func() { _ = s.close <- 1 }()
+		return s.rwc.Close()
+	}
+
+	go func() {
+		select {
+		case <-s.closing:
+		case <-time.After(s.closeTimeout):
+		}
+		s.rwc.Close()
+		_ = s.close <- 1
+	}()
+	return nil
+}
+
+// HijackRecorder records the connection the websocket package hijacks through it,
+// so the socket can write the closing frame that the package doesn't know of.
+type hijackRecorder struct {
+	http.ResponseWriter
+	s *websocketSocket
+}
+
+func (w *hijackRecorder) Hijack() (rwc io.ReadWriteCloser, buf *bufio.ReadWriter, err os.Error) {
+	if rwc, buf, err = w.ResponseWriter.Hijack(); err == nil {
+		w.s.rwc, w.s.buf = rwc, buf
+	}
+	return
+}
+
+// TCPOptionsWriter applies the TCP options to the connection that is hijacked
+// through it. The websocket package hijacks the connection by itself, so this is
+// the only place where the options can be set. The keepalive is left alone unless
+// it is enabled.
+type tcpOptionsWriter struct {
+	http.ResponseWriter
+	noDelay   bool
+	keepAlive bool
+}
+
+// TCPOptioner is the part of *net.TCPConn the TCP options are applied through.
+type tcpOptioner interface {
+	SetNoDelay(noDelay bool) os.Error
+	SetKeepAlive(keepAlive bool) os.Error
+}
+
+func (w *tcpOptionsWriter) Hijack() (rwc io.ReadWriteCloser, buf *bufio.ReadWriter, err os.Error) {
+	if rwc, buf, err = w.ResponseWriter.Hijack(); err != nil {
+		return
+	}
+
+	if tcp, ok := rwc.(tcpOptioner); ok {
+		tcp.SetNoDelay(w.noDelay)
+		if w.keepAlive {
+			tcp.SetKeepAlive(true)
+		}
+	}
+	return
 }
@@ -0,0 +1,95 @@
+package socketio
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestWebsocketConn is the client end of a hijacked websocket connection.
+type testWebsocketConn struct {
+	io.Reader
+	written bytes.Buffer
+	closed  chan bool
+}
+
+func (c *testWebsocketConn) Write(p []byte) (int, os.Error) {
+	return c.written.Write(p)
+}
+
+func (c *testWebsocketConn) Close() os.Error {
+	_ = c.closed <- true
+	return nil
+}
+
+func newClosingSocket(r io.Reader, timeout int64) (*websocketSocket, *testWebsocketConn) {
+	conn := &testWebsocketConn{Reader: r, closed: make(chan bool, 1)}
+	return &websocketSocket{
+		connected:    true,
+		close:        make(chan byte, 1),
+		rwc:          conn,
+		buf:          bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(&conn.written)),
+		draft76:      true,
+		closeTimeout: timeout,
+	}, conn
+}
+
+func TestWebsocketCloseHandshake(t *testing.T) {
+	pr, pw := io.Pipe()
+	s, conn := newClosingSocket(pr, 5e9)
+
+	if err := s.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if conn.written.String() != "\xff\x00" {
+		t.Fatalf("Expected the closing frame to be sent, but got %q", conn.written.String())
+	}
+
+	// the server waits for the reply
+	read := make(chan os.Error)
+	go func() {
+		_, err := s.Read(make([]byte, 16))
+		read <- err
+	}()
+	time.Sleep(50e6)
+	if _, ok := <-conn.closed; ok {
+		t.Fatal("Did not expect the connection to be dropped before the client has replied")
+	}
+
+	go pw.Write([]byte("\x00late\xff\xff\x00"))
+	if err := <-read; err != os.EOF {
+		t.Fatalf("Expected os.EOF after the closing frame, but got %v", err)
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(1e9):
+		t.Fatal("Expected the connection to be dropped once the client has replied")
+	}
+}
+
+func TestWebsocketCloseHandshakeTimeout(t *testing.T) {
+	pr, _ := io.Pipe()
+	s, conn := newClosingSocket(pr, 100e6)
+
+	start := time.Nanoseconds()
+	s.Close()
+	select {
+	case <-conn.closed:
+	case <-time.After(5e9):
+		t.Fatal("Expected the connection to be dropped after the timeout")
+	}
+	if waited := time.Nanoseconds() - start; waited < 100e6 {
+		t.Fatalf("Expected the server to wait for the reply, but it dropped the connection after %d ns", waited)
+	}
+
+	// draft-75 has no closing handshake
+	s, conn = newClosingSocket(pr, 100e6)
+	s.draft76 = false
+	s.Close()
+	if _, ok := <-conn.closed; !ok || conn.written.Len() != 0 {
+		t.Fatalf("Expected a draft-75 connection to be dropped right away, but got %q", conn.written.String())
+	}
+}
@@ -26,7 +26,7 @@ func (t *xhrMultipartTransport) Resource() string {
 }
 
 // Creates a new socket that can be used with a connection.
-func (t *xhrMultipartTransport) newSocket() socket {
+func (t *xhrMultipartTransport) newSocket(config *Config) socket {
 	return &xhrMultipartSocket{t: t}
 }
 
@@ -26,7 +26,7 @@ func (t *xhrPollingTransport) Resource() string {
 }
 
 // Creates a new socket that can be used with a connection.
-func (t *xhrPollingTransport) newSocket() socket {
+func (t *xhrPollingTransport) newSocket(config *Config) socket {
 	return &xhrPollingSocket{t: t}
 }
 
@@ -1,6 +1,7 @@
 package socketio
 
 import (
+	"io"
 	"log"
 	"os"
 )
@@ -11,6 +12,41 @@ func (nw nopWriter) Write(p []byte) (n int, err os.Error) {
 	return len(p), nil
 }
 
+// ReadCloser combines a reader with the closer of another one, e.g. a limited
+// view of a request body with the body itself.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// TokenBucket paces events to a rate, allowing bursts of up to a second's worth
+// of them.
+type tokenBucket struct {
+	tokens float64 // The events that can be allowed right away.
+	at     int64   // The time the tokens were last topped up.
+}
+
+// NewTokenBucket creates a full bucket for the given rate per second.
+func newTokenBucket(rate float64, now int64) *tokenBucket {
+	return &tokenBucket{tokens: rate, at: now}
+}
+
+// Take tops up the bucket at the given rate per second and takes a token from it.
+// It returns false if the bucket was empty.
+func (b *tokenBucket) take(rate float64, now int64) bool {
+	b.tokens += float64(now-b.at) * rate / 1e9
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.at = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
 var (
 	NOPLogger     = log.New(nopWriter{}, "", 0)
 	DefaultLogger = log.New(os.Stdout, "", log.Ldate|log.Ltime)